@@ -3,6 +3,8 @@
 // Date: 2020-11-24
 package domain
 
+import "context"
+
 // User properties
 type User struct {
 	UserID       int64  `json:"user_id,omitempty"`
@@ -23,14 +25,14 @@ type User struct {
 // Users slice of users
 type Users []User
 
-// UserRepoI behavior of user repo
+// UserRepoI behavior of user repo, calls are canceled with ctx
 type UserRepoI interface {
-	AddUser(User) (*User, error)
-	GetUsers(int64, int64) (Users, int64, error)
-	GetUserByID(int64) (*User, error)
-	UserSetPass(int64, string) error
-	DelUser(int64) error
-	Login(uLogin, uPass string) (*User, error)
+	AddUser(context.Context, User) (*User, error)
+	GetUsers(context.Context, int64, int64) (Users, int64, error)
+	GetUserByID(context.Context, int64) (*User, error)
+	UserSetPass(context.Context, int64, string) error
+	DelUser(context.Context, int64) error
+	Login(ctx context.Context, uLogin, uPass string) (*User, error)
 	GetSrvPortDB() string
-	HealthCheck() error
+	HealthCheck(context.Context) error
 }
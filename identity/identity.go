@@ -0,0 +1,270 @@
+// Package identity contains signing and verification of the short-lived JWT
+// which wda.back forwards to the upstream services instead of raw X-User-* headers.
+// Upstream services import this package for the token verification.
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Header is default name of the header with identity token
+	Header string = "X-User-Identity"
+	// AlgHS256 HMAC SHA-256 signature
+	AlgHS256 string = "HS256"
+	// AlgEdDSA Ed25519 signature
+	AlgEdDSA string = "EdDSA"
+	typJWT   string = "JWT"
+)
+
+var (
+	// ErrMalformed token isn't well formed JWT
+	ErrMalformed = errors.New("malformed identity token")
+	// ErrUnknownKey token signed by unknown key or algorithm
+	ErrUnknownKey = errors.New("unknown identity token key")
+	// ErrSignature token signature doesn't match
+	ErrSignature = errors.New("identity token signature mismatch")
+	// ErrExpired token expired or not valid yet
+	ErrExpired = errors.New("identity token expired")
+	// ErrIssuer token issued by unexpected issuer
+	ErrIssuer = errors.New("identity token unexpected issuer")
+	// ErrNoToken request doesn't contain identity token
+	ErrNoToken = errors.New("identity token not found")
+)
+
+// Claims identity of the user
+type Claims struct {
+	UID         string          `json:"sub"`
+	Login       string          `json:"login,omitempty"`
+	Domain      string          `json:"domain,omitempty"`
+	Permissions json.RawMessage `json:"perms,omitempty"`
+	Issuer      string          `json:"iss,omitempty"`
+	IssuedAt    int64           `json:"iat"`
+	ExpiresAt   int64           `json:"exp"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// Key signing or verification key with the key id
+type Key struct {
+	ID      string
+	Alg     string
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// NewHS256Key makes HMAC SHA-256 key
+func NewHS256Key(kid string, secret []byte) Key {
+	return Key{ID: kid, Alg: AlgHS256, secret: secret}
+}
+
+// NewEdDSAKey makes Ed25519 key for signing and verification
+func NewEdDSAKey(kid string, private ed25519.PrivateKey) Key {
+	return Key{ID: kid, Alg: AlgEdDSA, private: private, public: private.Public().(ed25519.PublicKey)}
+}
+
+// NewEdDSAPublicKey makes Ed25519 key only for verification
+func NewEdDSAPublicKey(kid string, public ed25519.PublicKey) Key {
+	return Key{ID: kid, Alg: AlgEdDSA, public: public}
+}
+
+// ParseEdDSAKeyPEM makes Ed25519 key from PEM with PKCS8 private key or PKIX public key
+func ParseEdDSAKeyPEM(kid string, data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, errors.New("pem block not found")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return Key{}, err
+		}
+		private, ok := k.(ed25519.PrivateKey)
+		if !ok {
+			return Key{}, fmt.Errorf("private key isn't ed25519, %T", k)
+		}
+		return NewEdDSAKey(kid, private), nil
+	case "PUBLIC KEY":
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return Key{}, err
+		}
+		public, ok := k.(ed25519.PublicKey)
+		if !ok {
+			return Key{}, fmt.Errorf("public key isn't ed25519, %T", k)
+		}
+		return NewEdDSAPublicKey(kid, public), nil
+	default:
+		return Key{}, fmt.Errorf("unsupported pem block %s", block.Type)
+	}
+}
+
+func (k Key) sign(data []byte) ([]byte, error) {
+	switch k.Alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		_, _ = mac.Write(data)
+		return mac.Sum(nil), nil
+	case AlgEdDSA:
+		if k.private == nil {
+			return nil, fmt.Errorf("key %s can't sign, private key not defined", k.ID)
+		}
+		return ed25519.Sign(k.private, data), nil
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", k.Alg)
+	}
+}
+
+func (k Key) verify(data, sig []byte) bool {
+	switch k.Alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		_, _ = mac.Write(data)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case AlgEdDSA:
+		return len(k.public) == ed25519.PublicKeySize && ed25519.Verify(k.public, data, sig)
+	default:
+		return false
+	}
+}
+
+// Signer mints identity tokens
+type Signer struct {
+	key    Key
+	issuer string
+	ttl    time.Duration
+}
+
+// NewSigner makes new instance of the Signer, ttl - lifetime of the token
+func NewSigner(key Key, issuer string, ttl time.Duration) *Signer {
+	return &Signer{key: key, issuer: issuer, ttl: ttl}
+}
+
+// Sign makes signed token with the claims, issuer and lifetime are set by the Signer
+func (s *Signer) Sign(c Claims) (string, error) {
+	now := time.Now()
+	c.Issuer = s.issuer
+	c.IssuedAt = now.Unix()
+	c.ExpiresAt = now.Add(s.ttl).Unix()
+	hb, err := json.Marshal(header{Alg: s.key.Alg, Typ: typJWT, Kid: s.key.ID})
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signing := enc.EncodeToString(hb) + "." + enc.EncodeToString(cb)
+	sig, err := s.key.sign([]byte(signing))
+	if err != nil {
+		return "", err
+	}
+	return signing + "." + enc.EncodeToString(sig), nil
+}
+
+// Verifier checks identity tokens, accepts tokens signed by any of the keys,
+// so keys can be rotated by adding new key id before signer switching
+type Verifier struct {
+	keys   map[string]Key
+	header string
+	issuer string
+	leeway time.Duration
+	now    func() time.Time
+}
+
+// NewVerifier makes new instance of the Verifier,
+// issuer - expected issuer, empty - any, leeway - allowed clock skew,
+// token is read from the Header, see SetHeader
+func NewVerifier(issuer string, leeway time.Duration, keys ...Key) *Verifier {
+	v := &Verifier{
+		keys:   make(map[string]Key, len(keys)),
+		header: Header,
+		issuer: issuer,
+		leeway: leeway,
+		now:    time.Now,
+	}
+	for _, k := range keys {
+		v.keys[k.ID] = k
+	}
+	return v
+}
+
+// Verify checks token and returns its claims
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	enc := base64.RawURLEncoding
+	hb, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	h := header{}
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return nil, ErrMalformed
+	}
+	key, ok := v.keys[h.Kid]
+	if !ok || key.Alg != h.Alg {
+		return nil, ErrUnknownKey
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return nil, ErrSignature
+	}
+	cb, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	c := &Claims{}
+	if err := json.Unmarshal(cb, c); err != nil {
+		return nil, ErrMalformed
+	}
+	now := v.now()
+	if now.After(time.Unix(c.ExpiresAt, 0).Add(v.leeway)) || now.Add(v.leeway).Before(time.Unix(c.IssuedAt, 0)) {
+		return nil, ErrExpired
+	}
+	if v.issuer != "" && c.Issuer != v.issuer {
+		return nil, ErrIssuer
+	}
+	return c, nil
+}
+
+// SetHeader sets name of the header with token, it must match identity.header of wda.back,
+// empty name resets it to the Header
+func (v *Verifier) SetHeader(name string) {
+	if name == "" {
+		name = Header
+	}
+	v.header = name
+}
+
+// FromRequest verifies token from the header of the request
+func (v *Verifier) FromRequest(r *http.Request) (*Claims, error) {
+	token := r.Header.Get(v.header)
+	if token == "" {
+		return nil, ErrNoToken
+	}
+	return v.Verify(token)
+}
@@ -0,0 +1,96 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := NewHS256Key("2021-06", []byte("old secret"))
+	newKey := NewHS256Key("2021-07", []byte("new secret"))
+	edKey := NewEdDSAKey("ed-1", private)
+	v := NewVerifier("wda.back", time.Second, oldKey, newKey,
+		NewEdDSAPublicKey(edKey.ID, edKey.public))
+	claims := Claims{UID: "42", Login: "admin", Domain: "countmax", Permissions: json.RawMessage(`[]`)}
+
+	for _, k := range []Key{oldKey, newKey, edKey} {
+		t.Run(k.ID, func(t *testing.T) {
+			token, err := NewSigner(k, "wda.back", time.Minute).Sign(claims)
+			if err != nil {
+				t.Fatalf("Signer.Sign() error = %v", err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set(Header, token)
+			got, err := v.FromRequest(r)
+			if err != nil {
+				t.Fatalf("Verifier.FromRequest() error = %v", err)
+			}
+			if got.UID != claims.UID || got.Login != claims.Login || got.Domain != claims.Domain {
+				t.Errorf("Verifier.FromRequest() = %+v, want %+v", got, claims)
+			}
+		})
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	key := NewHS256Key("k1", []byte("secret"))
+	v := NewVerifier("wda.back", 0, key)
+	token, err := NewSigner(key, "wda.back", time.Minute).Sign(Claims{UID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, _ := NewSigner(NewHS256Key("k1", []byte("guess")), "wda.back", time.Minute).Sign(Claims{UID: "1"})
+	unknown, _ := NewSigner(NewHS256Key("k2", []byte("secret")), "wda.back", time.Minute).Sign(Claims{UID: "1"})
+	expired, _ := NewSigner(key, "wda.back", -time.Minute).Sign(Claims{UID: "1"})
+	foreign, _ := NewSigner(key, "other", time.Minute).Sign(Claims{UID: "1"})
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + parts[1] + "x." + parts[2]
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"malformed", "abc", ErrMalformed},
+		{"forged", forged, ErrSignature},
+		{"tampered", tampered, ErrSignature},
+		{"unknown_kid", unknown, ErrUnknownKey},
+		{"expired", expired, ErrExpired},
+		{"issuer", foreign, ErrIssuer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := v.Verify(tt.token); !errors.Is(err, tt.want) {
+				t.Errorf("Verifier.Verify() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifier_SetHeader(t *testing.T) {
+	key := NewHS256Key("k1", []byte("secret"))
+	token, err := NewSigner(key, "wda.back", time.Minute).Sign(Claims{UID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewVerifier("wda.back", 0, key)
+	v.SetHeader("X-Identity")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(Header, token)
+	if _, err := v.FromRequest(r); !errors.Is(err, ErrNoToken) {
+		t.Errorf("Verifier.FromRequest() of default header error = %v, want %v", err, ErrNoToken)
+	}
+	r.Header.Set("X-Identity", token)
+	if got, err := v.FromRequest(r); err != nil || got.UID != "1" {
+		t.Errorf("Verifier.FromRequest() = %+v, %v, want UID 1", got, err)
+	}
+}
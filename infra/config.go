@@ -79,6 +79,10 @@ func (s *Server) consulRegister() {
 	}
 	s.consul = consul.Agent()
 	tags := strings.Split(s.config.GetString("tags"), ",")
+	healthScheme := "http"
+	if s.serviceCerts != nil {
+		healthScheme = "https"
+	}
 	err = consul.Agent().ServiceRegister(
 		&consulapi.AgentServiceRegistration{
 			ID:                s.config.GetString("consul.serviceid"),
@@ -90,7 +94,8 @@ func (s *Server) consulRegister() {
 			EnableTagOverride: false,
 			Check: &consulapi.AgentServiceCheck{
 				DeregisterCriticalServiceAfter: "90m",
-				HTTP: fmt.Sprintf("http://%s:%d/health",
+				HTTP: fmt.Sprintf("%s://%s:%d/health",
+					healthScheme,
 					s.config.GetString("consul.address"),
 					s.config.GetInt("consul.port")),
 				Interval: "60s",
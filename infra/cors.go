@@ -0,0 +1,59 @@
+package infra
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// setCORS makes CORS policy of the api from httpd.allow_origins and httpd.cors, without origins CORS is disabled
+func (s *Server) setCORS() error {
+	origins := s.config.GetStringSlice("httpd.allow_origins")
+	if len(origins) == 0 {
+		return nil
+	}
+	credentials := s.config.GetBool("httpd.cors.allow_credentials")
+	if credentials {
+		for _, o := range origins {
+			if o == "*" {
+				return errors.New("httpd.allow_origins must list origins explicitly if httpd.cors.allow_credentials is set")
+			}
+		}
+	}
+	cfg := middleware.DefaultCORSConfig
+	cfg.Skipper = func(c echo.Context) bool {
+		return !s.isAPIPath(c.Request().URL.Path)
+	}
+	cfg.AllowOrigins = origins
+	if methods := s.config.GetStringSlice("httpd.cors.allow_methods"); len(methods) > 0 {
+		cfg.AllowMethods = methods
+	}
+	cfg.AllowHeaders = s.config.GetStringSlice("httpd.cors.allow_headers")
+	cfg.ExposeHeaders = s.config.GetStringSlice("httpd.cors.expose_headers")
+	cfg.AllowCredentials = credentials
+	cfg.MaxAge = int(s.config.GetDuration("httpd.cors.max_age").Seconds())
+	s.corsConfig = &cfg
+	s.log.Infof("CORS enabled, origins %v, credentials=%t", origins, credentials)
+	return nil
+}
+
+// isAPIPath returns true for the local api and the proxied routes
+func (s *Server) isAPIPath(path string) bool {
+	if hasPathPrefix(path, "/"+apiLocalVersion) {
+		return true
+	}
+	for _, r := range s.routes {
+		if hasPathPrefix(path, r.cfg.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPathPrefix returns true if path is the prefix or is nested in it
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
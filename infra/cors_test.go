@@ -0,0 +1,72 @@
+package infra
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+func TestServer_corsPreflight(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	config := viper.New()
+	config.Set("httpd.allow_origins", []string{"https://wda.local"})
+	config.Set("httpd.cors.allow_credentials", true)
+	config.Set("proxy.routes", []RouteConfig{
+		{Name: "layoutconfig.api", Prefix: "/v2", Upstreams: []UpstreamConfig{{URL: upstream.URL}}},
+	})
+	s := &Server{
+		log:      zap.NewNop().Sugar(),
+		config:   config,
+		sess:     fakeSessManager{},
+		handler:  &http.Client{Transport: http.DefaultTransport},
+		mService: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_cors_service_up"}, []string{"scope", "destination", "version", "githash", "build"}),
+	}
+	if err := s.setCORS(); err != nil {
+		t.Fatalf("Server.setCORS() error = %v", err)
+	}
+	routes, err := s.newProxyRoutes()
+	if err != nil {
+		t.Fatalf("Server.newProxyRoutes() error = %v", err)
+	}
+	s.routes = routes
+	e := echo.New()
+	e.Use(middleware.CORSWithConfig(*s.corsConfig))
+	s.registerProxyRoutes(e)
+
+	tests := []struct {
+		name       string
+		method     string
+		origin     string
+		wantCode   int
+		wantOrigin string
+	}{
+		{"preflight", http.MethodOptions, "https://wda.local", http.StatusNoContent, "https://wda.local"},
+		{"preflight_unknown_origin", http.MethodOptions, "https://evil.local", http.StatusNoContent, ""},
+		{"request_without_session", http.MethodGet, "https://wda.local", http.StatusUnauthorized, "https://wda.local"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/v2/layouts", nil)
+			req.Header.Set(echo.HeaderOrigin, tt.origin)
+			req.Header.Set(echo.HeaderAccessControlRequestMethod, http.MethodPut)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("response code = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+		})
+	}
+}
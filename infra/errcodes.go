@@ -0,0 +1,172 @@
+package infra
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// application error codes of ErrResponse, values are stable, the frontend reacts to them
+const (
+	CodeInternal               int64 = 1000 // unexpected server error
+	CodeValidation             int64 = 1001 // request validation failed
+	CodeNotFound               int64 = 1002 // resource not found
+	CodeRouteNotFound          int64 = 1003 // there is no such api route
+	CodeMethodNotAllowed       int64 = 1004 // route doesn't support the method
+	CodeTooManyRequests        int64 = 1005 // rate limit exceeded
+	CodeSessionMissing         int64 = 2001 // request without session token
+	CodeSessionExpired         int64 = 2002 // session not found or expired
+	CodeLoginPass              int64 = 2003 // wrong login or password
+	CodePermissionDenied       int64 = 2004 // subject doesn't have required relation
+	CodePermissionsUnavailable int64 = 2005 // permission manager unavailable
+	CodeUpstreamUnavailable    int64 = 3001 // upstream unavailable or there are no upstream targets
+	CodeUpstreamTimeout        int64 = 3002 // upstream didn't respond in time
+	CodeCircuitOpen            int64 = 3003 // circuit breakers of all upstream targets are open
+	CodeClientClosed           int64 = 3004 // client closed connection before upstream responded
+	CodeRepoUnavailable        int64 = 4001 // users repository unavailable
+	CodeUserNotFound           int64 = 4002 // user not found
+	CodeLoginExists            int64 = 4003 // user with the login already exists
+)
+
+const (
+	mimeProblemJSON   string = "application/problem+json"
+	problemTypePrefix string = "urn:wda.back:error:"
+)
+
+const (
+	langRU      string = "ru"
+	langEN      string = "en"
+	defaultLang string = langRU
+)
+
+// errCatalogue localized messages of the application error codes
+var errCatalogue = map[int64]map[string]string{
+	CodeInternal:               {langEN: "Internal server error", langRU: "Внутренняя ошибка сервера"},
+	CodeValidation:             {langEN: "Request validation failed", langRU: "Некорректный запрос"},
+	CodeNotFound:               {langEN: "Resource not found", langRU: "Ресурс не найден"},
+	CodeRouteNotFound:          {langEN: "API route not found", langRU: "Маршрут API не найден"},
+	CodeMethodNotAllowed:       {langEN: "Method not allowed", langRU: "Метод не поддерживается"},
+	CodeTooManyRequests:        {langEN: "Too many requests, try again later", langRU: "Слишком много запросов, повторите позже"},
+	CodeSessionMissing:         {langEN: "Session is missing, please log in", langRU: "Нет сессии, выполните вход"},
+	CodeSessionExpired:         {langEN: "Session expired, please log in again", langRU: "Сессия истекла, выполните вход заново"},
+	CodeLoginPass:              {langEN: "Wrong login or password", langRU: "Неверный логин или пароль"},
+	CodePermissionDenied:       {langEN: "Permission denied", langRU: "Недостаточно прав"},
+	CodePermissionsUnavailable: {langEN: "Permissions are temporarily unavailable", langRU: "Права временно недоступны"},
+	CodeUpstreamUnavailable:    {langEN: "Service is temporarily unavailable", langRU: "Сервис временно недоступен"},
+	CodeUpstreamTimeout:        {langEN: "Service didn't respond in time", langRU: "Сервис не ответил вовремя"},
+	CodeCircuitOpen:            {langEN: "Service is temporarily unavailable", langRU: "Сервис временно недоступен"},
+	CodeClientClosed:           {langEN: "Request canceled by client", langRU: "Запрос отменен клиентом"},
+	CodeRepoUnavailable:        {langEN: "Users storage is temporarily unavailable", langRU: "Хранилище пользователей временно недоступно"},
+	CodeUserNotFound:           {langEN: "User not found", langRU: "Пользователь не найден"},
+	CodeLoginExists:            {langEN: "User with this login already exists", langRU: "Пользователь с таким логином уже существует"},
+}
+
+// codeByStatus returns application error code of the http status, used for errors without own code
+func codeByStatus(status int) int64 {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeValidation
+	case http.StatusUnauthorized:
+		return CodeSessionMissing
+	case http.StatusForbidden:
+		return CodePermissionDenied
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeLoginExists
+	case http.StatusTooManyRequests:
+		return CodeTooManyRequests
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return CodeUpstreamUnavailable
+	case http.StatusGatewayTimeout:
+		return CodeUpstreamTimeout
+	default:
+		return CodeInternal
+	}
+}
+
+// errMessage returns message of the code in the language, default language is used for unknown one
+func errMessage(code int64, lang string) string {
+	msgs, ok := errCatalogue[code]
+	if !ok {
+		return ""
+	}
+	if msg, ok := msgs[lang]; ok {
+		return msg
+	}
+	return msgs[defaultLang]
+}
+
+// requestLang returns the first supported language of Accept-Language, default language if there is no such
+func requestLang(r *http.Request) string {
+	for _, tag := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag = strings.TrimSpace(strings.SplitN(tag, ";", 2)[0])
+		lang := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		if lang == langRU || lang == langEN {
+			return lang
+		}
+	}
+	return defaultLang
+}
+
+// sendError writes ErrResponse with the localized message and the request id,
+// or ProblemResponse if the client accepts application/problem+json
+func sendError(c echo.Context, resp ErrResponse) error {
+	if resp.AppCode == 0 {
+		resp.AppCode = codeByStatus(resp.HTTPStatusCode)
+	}
+	resp.Message = errMessage(resp.AppCode, requestLang(c.Request()))
+	resp.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+	if !acceptsProblem(c.Request()) {
+		return c.JSON(resp.HTTPStatusCode, resp)
+	}
+	bts, err := json.Marshal(ProblemResponse{
+		Type:      fmt.Sprintf("%s%d", problemTypePrefix, resp.AppCode),
+		Title:     resp.Message,
+		Status:    resp.HTTPStatusCode,
+		Detail:    resp.ErrorText,
+		Instance:  c.Request().URL.Path,
+		Code:      resp.AppCode,
+		RequestID: resp.RequestID,
+	})
+	if err != nil {
+		return err
+	}
+	return c.Blob(resp.HTTPStatusCode, mimeProblemJSON, bts)
+}
+
+// acceptsProblem returns true if the client accepts RFC 7807 problem details explicitly,
+// with q above zero and not below q of application/json; wildcards select the default ErrResponse
+func acceptsProblem(r *http.Request) bool {
+	problem := acceptQuality(r, mimeProblemJSON)
+	return problem > 0 && problem >= acceptQuality(r, echo.MIMEApplicationJSON)
+}
+
+// acceptQuality returns q of the media type listed in the Accept, 0 if it isn't listed
+func acceptQuality(r *http.Request, mediaType string) float64 {
+	for _, h := range r.Header.Values(echo.HeaderAccept) {
+		for _, rng := range strings.Split(h, ",") {
+			mt, params, err := mime.ParseMediaType(rng)
+			if err != nil || mt != mediaType {
+				continue
+			}
+			q, ok := params["q"]
+			if !ok {
+				return 1
+			}
+			v, err := strconv.ParseFloat(q, 64)
+			if err != nil || v < 0 || v > 1 {
+				return 0
+			}
+			return v
+		}
+	}
+	return 0
+}
@@ -0,0 +1,108 @@
+package infra
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func Test_sendError(t *testing.T) {
+	tests := []struct {
+		name     string
+		lang     string
+		resp     ErrResponse
+		wantCode int64
+		wantMsg  string
+	}{
+		{"default_code_ru", "ru-RU,ru;q=0.9,en;q=0.8", ErrForbidden(errors.New("denied")), CodePermissionDenied, "Недостаточно прав"},
+		{"own_code_en", "en-US,en;q=0.9", ErrNotAuthorized(errors.New("expired")).WithCode(CodeSessionExpired), CodeSessionExpired, "Session expired, please log in again"},
+		{"unsupported_lang", "de", ErrServerInternal(errors.New("boom")), CodeInternal, "Внутренняя ошибка сервера"},
+		{"skip_unsupported_lang", "de, en;q=0.5", ErrTooManyRequests(errors.New("slow down")), CodeTooManyRequests, "Too many requests, try again later"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+			req.Header.Set("Accept-Language", tt.lang)
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			if err := sendError(c, tt.resp); err != nil {
+				t.Fatalf("sendError() error = %v", err)
+			}
+			if rec.Code != tt.resp.HTTPStatusCode {
+				t.Errorf("response code = %d, want %d", rec.Code, tt.resp.HTTPStatusCode)
+			}
+			got := ErrResponse{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("response isn't ErrResponse json, %v", err)
+			}
+			if got.AppCode != tt.wantCode || got.Message != tt.wantMsg {
+				t.Errorf("ErrResponse code, message = %d, %q, want %d, %q", got.AppCode, got.Message, tt.wantCode, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func Test_sendError_problem(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/v1/users/x", nil)
+	req.Header.Set(echo.HeaderAccept, "application/problem+json, application/json;q=0.5")
+	req.Header.Set("Accept-Language", "en")
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Response().Header().Set(echo.HeaderXRequestID, "req-1")
+	if err := sendError(c, ErrInvalidRequest(errors.New("bad user id"))); err != nil {
+		t.Fatalf("sendError() error = %v", err)
+	}
+	if ct := rec.Header().Get(echo.HeaderContentType); ct != mimeProblemJSON {
+		t.Errorf("Content-Type = %s, want %s", ct, mimeProblemJSON)
+	}
+	got := ProblemResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("response isn't problem json, %v", err)
+	}
+	want := ProblemResponse{
+		Type:      "urn:wda.back:error:1001",
+		Title:     "Request validation failed",
+		Status:    http.StatusBadRequest,
+		Detail:    "bad user id",
+		Instance:  "/v1/users/x",
+		Code:      CodeValidation,
+		RequestID: "req-1",
+	}
+	if got != want {
+		t.Errorf("ProblemResponse = %+v, want %+v", got, want)
+	}
+}
+
+func Test_acceptsProblem(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept []string
+		want   bool
+	}{
+		{"none", nil, false},
+		{"wildcard", []string{"*/*"}, false},
+		{"json", []string{"application/json"}, false},
+		{"problem", []string{"application/problem+json"}, true},
+		{"problem_preferred", []string{"application/json;q=0.5, application/problem+json"}, true},
+		{"json_preferred", []string{"application/problem+json;q=0.5, application/json"}, false},
+		{"problem_q0", []string{"application/problem+json;q=0, */*"}, false},
+		{"problem_q0_spaces", []string{"Application/Problem+JSON ; q=0.0"}, false},
+		{"problem_q_invalid", []string{"application/problem+json;q=x"}, false},
+		{"problem_second_header", []string{"text/html", "application/problem+json;q=0.9"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, a := range tt.accept {
+				req.Header.Add(echo.HeaderAccept, a)
+			}
+			if got := acceptsProblem(req); got != tt.want {
+				t.Errorf("acceptsProblem(%q) = %v, want %v", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package infra
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.countmax.ru/countmax/wda.back/domain"
+	"git.countmax.ru/countmax/wda.back/internal/session"
+	"git.countmax.ru/countmax/wda.back/repos"
+	"github.com/labstack/echo/v4"
+)
+
+var errEmptyCredentials = errors.New("login and password must be specified")
+
+// LoginRequest credentials of the user
+type LoginRequest struct {
+	Login    string `json:"login" form:"login"`
+	Password string `json:"password" form:"password"`
+}
+
+// LoginResponse issued session and the user properties,
+// token is returned only if session.token_in_body is enabled, otherwise it's in the cookie only
+type LoginResponse struct {
+	Token   string       `json:"token,omitempty"`
+	Expires time.Time    `json:"expires"`
+	User    *domain.User `json:"user"`
+}
+
+// apiLogin docs
+// @Summary Login
+// @Description check credentials, issue new session and set session cookie
+// @Accept  json
+// @Produce  json
+// @Tags auth
+// @Param credentials body infra.LoginRequest true "login and password"
+// @Success 200 {object} infra.LoginResponse
+// @Failure 400 {object} infra.ErrResponse
+// @Failure 401 {object} infra.ErrResponse
+// @Failure 500 {object} infra.ErrResponse
+// @Router /v1/auth/login [post]
+func (s *Server) apiLogin(c echo.Context) error {
+	req := LoginRequest{}
+	if err := c.Bind(&req); err != nil {
+		return sendError(c, ErrInvalidRequest(err))
+	}
+	if req.Login == "" || req.Password == "" {
+		return sendError(c, ErrInvalidRequest(errEmptyCredentials))
+	}
+	ctx, span := s.repoSpan(c, "Login")
+	u, err := s.repo.Login(ctx, req.Login, req.Password)
+	endSpan(span, err)
+	if err != nil {
+		if errors.Is(err, repos.ErrLoginPass) {
+			s.reqLog(c.Request().Context()).Warnf("login %s failed, %v", req.Login, err)
+			return sendError(c, ErrNotAuthorized(err).WithCode(CodeLoginPass))
+		}
+		s.reqLog(c.Request().Context()).Errorf("repo.Login(%s) error, %v", req.Login, err)
+		return sendError(c, ErrServerInternal(err).WithCode(CodeRepoUnavailable))
+	}
+	token, err := s.localSess.Create(&session.Session{
+		UID:        strconv.FormatInt(u.UserID, 10),
+		Login:      u.Login,
+		UserDomain: u.DomainName,
+	})
+	if err != nil {
+		s.reqLog(c.Request().Context()).Errorf("create session for %s error, %v", u.Login, err)
+		return sendError(c, ErrServerInternal(err))
+	}
+	expires := time.Now().Add(s.localSess.TTL())
+	c.SetCookie(&http.Cookie{
+		Name:     sessCookieID,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   s.secureCookie(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	hideSecrets(u)
+	resp := LoginResponse{Expires: expires, User: u}
+	if s.tokenInBody {
+		resp.Token = token
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// secureCookie returns true if the session cookie must be sent over https only
+func (s *Server) secureCookie() bool {
+	return s.cookieSecure || s.httpdCerts != nil
+}
+
+// apiLogout docs
+// @Summary Logout
+// @Description drop current session and session cookie
+// @Produce  json
+// @Tags auth
+// @Success 200 {object} infra.SuccessResponse
+// @Router /v1/auth/logout [post]
+func (s *Server) apiLogout(c echo.Context) error {
+	rawSessionID, sessionSource := s.getSessionID(c)
+	if rawSessionID != "" {
+		sessID := &session.ID{ID: rawSessionID, Src: sessionSource}
+		s.localSess.Delete(sessID)
+		if s.sessCache != nil {
+			s.sessCache.Evict(sessID)
+		}
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     sessCookieID,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   s.secureCookie(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.JSON(http.StatusOK, OkStatus("logged out"))
+}
@@ -0,0 +1,211 @@
+package infra
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"git.countmax.ru/countmax/wda.back/internal/session"
+	"github.com/labstack/echo/v4"
+)
+
+const sessionKey string = "session"
+
+var errPermissionDenied = errors.New("permission denied")
+
+// defaultUsersAdmin relation required for the users api if users.admin isn't defined
+var defaultUsersAdmin = AuthzRule{Namespace: "data.users", Object: "users", Relation: "admin"}
+
+// AuthzRule requires relation to the object in the namespace
+// for requests matched by methods and path pattern
+type AuthzRule struct {
+	Methods   []string `mapstructure:"methods"`   // http methods, empty - any method
+	Path      string   `mapstructure:"path"`      // path pattern, * at the end matches by prefix
+	Namespace string   `mapstructure:"namespace"` // keto namespace, permissions filter
+	Object    string   `mapstructure:"object"`    // keto object
+	Relation  string   `mapstructure:"relation"`  // keto relation
+}
+
+var errNonCanonicalPath = errors.New("path must be canonical, without empty, . and .. segments and encoded separators")
+
+// match checks the request by the rule
+func (r AuthzRule) match(method, path string) bool {
+	if !matchPath(r.Path, path) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// permTuple keto relation tuple
+type permTuple struct {
+	Namespace string `json:"namespace"`
+	Object    string `json:"object"`
+	Relation  string `json:"relation"`
+}
+
+// hasRelation checks base64 permissions for the relation to the object in the namespace
+func hasRelation(perms, namespace, object, relation string) (bool, error) {
+	if perms == "" {
+		return false, nil
+	}
+	bts, err := b64.StdEncoding.DecodeString(perms)
+	if err != nil {
+		return false, fmt.Errorf("decode permissions error, %w", err)
+	}
+	var tuples []permTuple
+	if err := json.Unmarshal(bts, &tuples); err != nil {
+		// keto list response
+		var resp struct {
+			RelationTuples []permTuple `json:"relation_tuples"`
+		}
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return false, fmt.Errorf("unmarshal permissions error, %w", err)
+		}
+		tuples = resp.RelationTuples
+	}
+	for _, t := range tuples {
+		if t.Namespace == namespace && t.Object == object && t.Relation == relation {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// setAuthzRules reads authorization rules from the config
+func (s *Server) setAuthzRules() error {
+	if !s.config.GetBool("authorization.enabled") {
+		return nil
+	}
+	var rules []AuthzRule
+	if err := s.config.UnmarshalKey("authorization.rules", &rules); err != nil {
+		return fmt.Errorf("read authorization.rules error, %w", err)
+	}
+	for _, r := range rules {
+		if r.Path == "" || r.Namespace == "" || r.Object == "" || r.Relation == "" {
+			return fmt.Errorf("bad authorization rule %+v, path, namespace, object and relation must be specified", r)
+		}
+		if err := checkPathPattern(r.Path); err != nil {
+			return err
+		}
+	}
+	s.authzRules = rules
+	s.log.Infof("authorization enabled, %d rules", len(rules))
+	return nil
+}
+
+// setUsersAdmin reads relation required for the users api from users.admin
+func (s *Server) setUsersAdmin() error {
+	rule := defaultUsersAdmin
+	if err := s.config.UnmarshalKey("users.admin", &rule); err != nil {
+		return fmt.Errorf("read users.admin error, %w", err)
+	}
+	if rule.Namespace == "" || rule.Object == "" || rule.Relation == "" {
+		return fmt.Errorf("bad users.admin %+v, namespace, object and relation must be specified", rule)
+	}
+	s.usersAdmin = &rule
+	s.log.Infof("users api requires relation %s to %s:%s", rule.Relation, rule.Namespace, rule.Object)
+	return nil
+}
+
+// authorize - middleware rejects requests if the session subject doesn't have
+// the relations required by all matched rules, must be used after checkSession
+func (s *Server) authorize(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if len(s.authzRules) == 0 {
+			return next(c)
+		}
+		sess, ok := c.Get(sessionKey).(*session.Session)
+		if !ok || sess == nil {
+			return sendError(c, ErrNotAuthorized(errors.New("session not found")).WithCode(CodeSessionMissing))
+		}
+		method := c.Request().Method
+		path := c.Request().URL.Path
+		for _, r := range s.authzRules {
+			if !r.match(method, path) {
+				continue
+			}
+			if allowed, err := s.checkRule(c, sess, r); !allowed {
+				return err
+			}
+		}
+		return next(c)
+	}
+}
+
+// requireRelation - middleware rejects requests if the session subject doesn't have the relation of the rule,
+// path and methods of the rule aren't checked, nil rule rejects all requests, must be used after checkSession
+func (s *Server) requireRelation(r *AuthzRule) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if r == nil {
+				return sendError(c, ErrForbidden(errPermissionDenied))
+			}
+			sess, ok := c.Get(sessionKey).(*session.Session)
+			if !ok || sess == nil {
+				return sendError(c, ErrNotAuthorized(errors.New("session not found")).WithCode(CodeSessionMissing))
+			}
+			if allowed, err := s.checkRule(c, sess, *r); !allowed {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+// checkRule checks the relation required by the rule, if it isn't satisfied sends error response
+// and returns false with the error of sending
+func (s *Server) checkRule(c echo.Context, sess *session.Session, r AuthzRule) (bool, error) {
+	perms, err := s.getPermissions(c.Request().Context(), sess, r.Namespace)
+	if err != nil {
+		return false, sendError(c, ErrServiceUnavailable(err).WithCode(CodePermissionsUnavailable))
+	}
+	allowed, err := hasRelation(perms, r.Namespace, r.Object, r.Relation)
+	if err != nil {
+		s.reqLog(c.Request().Context()).Errorf("check relation %s to %s for %s error, %v", r.Relation, r.Object, sess.UID, err)
+		return false, sendError(c, ErrServerInternal(err))
+	}
+	if !allowed {
+		s.reqLog(c.Request().Context()).Warnf("%s %s denied for %s, required relation %s to %s:%s",
+			c.Request().Method, c.Request().URL.Path, sess.UID, r.Relation, r.Namespace, r.Object)
+		return false, sendError(c, ErrForbidden(errPermissionDenied))
+	}
+	return true, nil
+}
+
+// requireCanonicalPath - middleware rejects requests with path which differs from its cleaned form,
+// so rules and filters matched by path can't be bypassed by //, /./, /../ or their encoded forms
+func (s *Server) requireCanonicalPath(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !isCanonicalPath(c.Request().URL) {
+			s.reqLog(c.Request().Context()).Warnf("reject non canonical path %s", c.Request().URL.EscapedPath())
+			return sendError(c, ErrInvalidRequest(errNonCanonicalPath))
+		}
+		return next(c)
+	}
+}
+
+// isCanonicalPath checks that unescaped path is cleaned and the raw path has no encoded separators or dots
+func isCanonicalPath(u *url.URL) bool {
+	p := u.Path
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if cleaned != p {
+		return false
+	}
+	raw := strings.ToLower(u.RawPath)
+	return !strings.Contains(raw, "%2f") && !strings.Contains(raw, "%2e") && !strings.Contains(raw, "%5c")
+}
@@ -0,0 +1,210 @@
+package infra
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	permcache "git.countmax.ru/countmax/wda.back/internal/permissions/cache"
+	"git.countmax.ru/countmax/wda.back/internal/permissions/keto"
+	"git.countmax.ru/countmax/wda.back/internal/session"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+func TestAuthzRule_match(t *testing.T) {
+	r := AuthzRule{Methods: []string{http.MethodPost}, Path: "/v2/layouts/*"}
+	tests := []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{http.MethodPost, "/v2/layouts/1", true},
+		{http.MethodPost, "/v2/layouts", true},
+		{http.MethodPost, "/v2/layoutsx", false},
+		{http.MethodGet, "/v2/layouts/1", false},
+	}
+	for _, tt := range tests {
+		if got := r.match(tt.method, tt.path); got != tt.want {
+			t.Errorf("AuthzRule.match(%s, %s) = %t, want %t", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestServer_requireCanonicalPath(t *testing.T) {
+	s := &Server{log: zap.NewNop().Sugar()}
+	tests := []struct {
+		target   string
+		wantCode int
+	}{
+		{"/v2/layouts/x", http.StatusOK},
+		{"/v2/layouts/", http.StatusOK},
+		{"/v2/layouts/x?path=//a/../b", http.StatusOK},
+		{"//v2/layouts/x", http.StatusBadRequest},
+		{"/v2/./layouts/x", http.StatusBadRequest},
+		{"/v2/reports/../layouts/x", http.StatusBadRequest},
+		{"/v2/%2e/layouts/x", http.StatusBadRequest},
+		{"/v2/%2E%2E/v2/layouts/x", http.StatusBadRequest},
+		{"/v2/layouts%2fx", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			u, err := url.ParseRequestURI(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.URL = u
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			h := s.requireCanonicalPath(func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+			if err := h(c); err != nil {
+				t.Fatalf("requireCanonicalPath() error = %v", err)
+			}
+			if rec.Code != tt.wantCode {
+				t.Errorf("requireCanonicalPath(%s) = %d, want %d", tt.target, rec.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestServer_authorize_proxy(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	// permissions are served from the cache only, keto is unavailable
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	km, err := keto.New(down.URL, time.Second, zap.NewNop().Sugar(), httpDuration)
+	if err != nil {
+		t.Fatalf("keto.New() error = %v", err)
+	}
+	// edit relation is granted in the other namespace only
+	perms := b64.StdEncoding.EncodeToString([]byte(`[` +
+		`{"namespace":"data.counting","object":"layouts","relation":"view"},` +
+		`{"namespace":"data.monitoring","object":"layouts","relation":"edit"}]`))
+	pc := permcache.New(time.Hour, time.Hour, 10)
+	for _, filter := range []string{defaultPermFilter, "data.counting"} {
+		_, _ = pc.Get("countmax:subjects:1|"+filter, func() (string, error) { return perms, nil })
+	}
+
+	config := viper.New()
+	config.Set("proxy.routes", []RouteConfig{
+		{Name: "layoutconfig.api", Prefix: "/v2", Upstreams: []UpstreamConfig{{URL: upstream.URL}}},
+	})
+	s := &Server{
+		log:         zap.NewNop().Sugar(),
+		config:      config,
+		sess:        fakeSessManager{sess: &session.Session{UID: "1", UserDomain: "countmax"}},
+		perm:        km,
+		permCache:   pc,
+		permTimeout: time.Second,
+		handler:     &http.Client{Transport: http.DefaultTransport},
+		mService:    prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_authz_service_up"}, []string{"scope", "destination", "version", "githash", "build"}),
+		authzRules: []AuthzRule{
+			{Methods: []string{http.MethodGet}, Path: "/v2/layouts/*", Namespace: "data.counting", Object: "layouts", Relation: "view"},
+			{Methods: []string{http.MethodPost}, Path: "/v2/layouts/*", Namespace: "data.counting", Object: "layouts", Relation: "edit"},
+		},
+	}
+	routes, err := s.newProxyRoutes()
+	if err != nil {
+		t.Fatalf("Server.newProxyRoutes() error = %v", err)
+	}
+	s.routes = routes
+	e := echo.New()
+	s.registerProxyRoutes(e)
+
+	tests := []struct {
+		name      string
+		method    string
+		wantCode  int
+		wantCalls int32
+	}{
+		{"allowed", http.MethodGet, http.StatusOK, 1},
+		{"denied", http.MethodPost, http.StatusForbidden, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+			req := httptest.NewRequest(tt.method, "/v2/layouts/1", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			req.Header.Set(echo.HeaderAccept, mimeProblemJSON)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("response code = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", got, tt.wantCalls)
+			}
+			if tt.wantCode == http.StatusOK {
+				return
+			}
+			if ct := rec.Header().Get(echo.HeaderContentType); ct != mimeProblemJSON {
+				t.Errorf("content type = %s, want %s", ct, mimeProblemJSON)
+			}
+			got := ProblemResponse{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got.Code != CodePermissionDenied {
+				t.Errorf("response = %s, want problem with code %d", rec.Body.String(), CodePermissionDenied)
+			}
+		})
+	}
+}
+
+func TestServer_requireRelation(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	km, err := keto.New(down.URL, time.Second, zap.NewNop().Sugar(), httpDuration)
+	if err != nil {
+		t.Fatalf("keto.New() error = %v", err)
+	}
+	admin := defaultUsersAdmin
+	tests := []struct {
+		name     string
+		tuples   string
+		rule     *AuthzRule
+		wantCode int
+	}{
+		{"admin", `[{"namespace":"data.users","object":"users","relation":"admin"}]`, &admin, http.StatusOK},
+		{"non_admin", `[{"namespace":"data.users","object":"users","relation":"view"}]`, &admin, http.StatusForbidden},
+		{"admin_other_namespace", `[{"namespace":"data.counting","object":"users","relation":"admin"}]`, &admin, http.StatusForbidden},
+		{"without_rule", `[{"namespace":"data.users","object":"users","relation":"admin"}]`, nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perms := b64.StdEncoding.EncodeToString([]byte(tt.tuples))
+			pc := permcache.New(time.Hour, time.Hour, 10)
+			for _, filter := range []string{defaultPermFilter, admin.Namespace} {
+				_, _ = pc.Get("countmax:subjects:1|"+filter, func() (string, error) { return perms, nil })
+			}
+			s := &Server{
+				log:         zap.NewNop().Sugar(),
+				sess:        fakeSessManager{sess: &session.Session{UID: "1", UserDomain: "countmax"}},
+				perm:        km,
+				permCache:   pc,
+				permTimeout: time.Second,
+			}
+			e := echo.New()
+			e.GET("/v1/users", func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			}, s.checkSession, s.requireRelation(tt.rule))
+			req := httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("response code = %d, want %d", rec.Code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -4,15 +4,23 @@ import (
 	"context"
 	b64 "encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	"git.countmax.ru/countmax/wda.back/internal/reqid"
 	"git.countmax.ru/countmax/wda.back/internal/session"
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 )
 
 const (
@@ -21,32 +29,104 @@ const (
 	kratosSessCookieID    string = "session_token"
 	oryKratosSessCookieID string = "ory_kratos_session"
 	PAGESIZE              int    = 10
+	MAXPAGESIZE           int    = 1000
 	XUserID               string = "X-User-ID"
 	XUserEMAIL            string = "X-User-EMAIL"
 	XUserPermission       string = "X-User-Permissions"
 )
 
+// customHTTPErrorHandler renders errors of the api as ErrResponse json,
+// other GET requests which accept html get index.html of the SPA, so the frontend router handles them
 func (s *Server) customHTTPErrorHandler(err error, c echo.Context) {
-	// routes := s.mux.Routes()
-	// for _, route := range routes {
-	// 	if route.Path == c.Path() {
-	// 		return
-	// 	}
-	// }
-	if err := c.File(vueURL); err != nil {
+	if c.Response().Committed {
+		return
+	}
+	req := c.Request()
+	if !s.isAPIPath(req.URL.Path) {
+		if (req.Method == http.MethodGet || req.Method == http.MethodHead) && acceptsHTML(req) {
+			if err := c.File(vueURL); err != nil {
+				c.Logger().Error(err)
+			}
+			return
+		}
+		c.Echo().DefaultHTTPErrorHandler(err, c)
+		return
+	}
+	code := http.StatusInternalServerError
+	msg := err
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		code = he.Code
+		msg = fmt.Errorf("%v", he.Message)
+	}
+	if code >= http.StatusInternalServerError {
+		s.reqLog(c.Request().Context()).Errorf("%s %s error, %v", req.Method, req.URL.Path, err)
+	}
+	resp := newErrResponse(code, msg)
+	if code == http.StatusNotFound {
+		// handlers render own not found errors, so echo one means unknown route
+		resp = resp.WithCode(CodeRouteNotFound)
+	}
+	if req.Method == http.MethodHead {
+		err = c.NoContent(code)
+	} else {
+		err = sendError(c, resp)
+	}
+	if err != nil {
 		c.Logger().Error(err)
 	}
 }
 
+// acceptsHTML returns true if the client accepts html, e.g. browser navigation
+func acceptsHTML(r *http.Request) bool {
+	accept := r.Header.Get(echo.HeaderAccept)
+	return strings.Contains(accept, echo.MIMETextHTML)
+}
+
+// requestContext - middleware puts the request id into the request context and header,
+// so it reaches handlers, managers and the upstream, must be used after middleware.RequestID;
+// invalid client-supplied id is replaced by the generated one
+func (s *Server) requestContext(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		rID := c.Response().Header().Get(echo.HeaderXRequestID)
+		if !reqid.Valid(rID) {
+			rID = reqid.New()
+			c.Response().Header().Set(echo.HeaderXRequestID, rID)
+		}
+		req := c.Request()
+		req.Header.Set(echo.HeaderXRequestID, rID)
+		c.SetRequest(req.WithContext(reqid.NewContext(req.Context(), rID)))
+		return next(c)
+	}
+}
+
+// reqLog returns logger with the request id and the trace id of ctx
+func (s *Server) reqLog(ctx context.Context) *zap.SugaredLogger {
+	return s.log.With(requestIDName, reqid.FromContext(ctx), traceIDName, traceID(ctx))
+}
+
 // customHTTPLogger - middleware of logger and metric duration
 func (s *Server) customHTTPLogger(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		start := time.Now()
+		ctx := traceProp.Extract(c.Request().Context(), propagation.HeaderCarrier(c.Request().Header))
+		ctx, span := s.startSpan(ctx, c.Request().Method+" "+c.Path(), trace.SpanKindServer)
+		c.SetRequest(c.Request().WithContext(ctx))
 		if err := next(c); err != nil {
 			c.Error(err)
 		}
-		rID := c.Response().Header().Get("x-request-id")
+		rID := reqid.FromContext(c.Request().Context())
 		code := c.Response().Status
+		span.SetAttributes(
+			attribute.String("http.method", c.Request().Method),
+			attribute.String("http.route", c.Path()),
+			attribute.String("http.target", c.Request().URL.Path),
+			attribute.Int("http.status_code", code),
+			attribute.String(requestIDName, rID))
+		if code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(code))
+		}
+		span.End()
 		uri := c.Request().URL.EscapedPath()
 		query := c.Request().URL.Query().Encode()
 		httplog := s.log.With(
@@ -58,7 +138,8 @@ func (s *Server) customHTTPLogger(next echo.HandlerFunc) echo.HandlerFunc {
 			"code", code,
 			"size", c.Response().Size,
 			"duration", time.Since(start).String(),
-			requestIDName, rID)
+			requestIDName, rID,
+			traceIDName, traceID(ctx))
 		host, err := os.Hostname()
 		if err != nil {
 			s.log.Warnf("define hostname error %s, set to localhost", err)
@@ -78,25 +159,60 @@ func (s *Server) customHTTPLogger(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// stripIdentityHeaders - middleware removes client-supplied identity headers,
+// so only headers set by checkSession reach the upstream
+func (s *Server) stripIdentityHeaders(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		for _, h := range s.stripHeaders {
+			if len(c.Request().Header.Values(h)) > 0 {
+				s.reqLog(c.Request().Context()).Warnf("drop client-supplied header %s from %s", h, c.Request().RemoteAddr)
+			}
+			c.Request().Header.Del(h)
+		}
+		return next(c)
+	}
+}
+
 // checkSession - middleware of logger and metric duration
 func (s *Server) checkSession(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		s.log.Debug("call checkSession")
 		rawSessionID, sessionSource := s.getSessionID(c)
 		sessID := &session.ID{ID: rawSessionID, Src: sessionSource}
-		session := s.sess.Check(sessID)
+		ctx, span := s.startSpan(c.Request().Context(), "session.check", trace.SpanKindClient)
+		session := s.sess.Check(ctx, sessID)
+		span.SetAttributes(attribute.Bool("session.found", session != nil))
+		span.End()
 		if session == nil {
-			s.log.Warnf("session not found by id=%+v, redirect to login page", sessID)
-			return c.NoContent(http.StatusUnauthorized)
+			s.reqLog(c.Request().Context()).Warnf("session not found by id=%+v, redirect to login page", sessID)
+			if rawSessionID == "" {
+				return sendError(c, ErrNotAuthorized(errNoSession).WithCode(CodeSessionMissing))
+			}
+			return sendError(c, ErrNotAuthorized(errSessionExpired).WithCode(CodeSessionExpired))
 		}
-		// set user attribute
-		c.Request().Header.Add(XUserID, session.UID)
-		c.Request().Header.Add(XUserEMAIL, session.Login)
+		c.Set(sessionKey, session)
 		// get permissions
-		perms := s.getPermissions(c.Request().Context(), session)
+		filter := s.permFilters.find(c.Request().URL.Path)
+		perms, err := s.getPermissions(c.Request().Context(), session, filter)
+		if err != nil {
+			return sendError(c, ErrServiceUnavailable(err).WithCode(CodePermissionsUnavailable))
+		}
 		s.log.Debugf("got permissions %s", perms)
-		if perms != "" {
-			c.Request().Header.Add(XUserPermission, perms)
+		if s.idSigner != nil {
+			// set signed user identity
+			token, err := s.signIdentity(session, perms)
+			if err != nil {
+				s.reqLog(c.Request().Context()).Errorf("sign identity for %s error, %v", session.UID, err)
+				return sendError(c, ErrServerInternal(err))
+			}
+			c.Request().Header.Set(s.idHeader, token)
+		} else {
+			// set user attribute
+			c.Request().Header.Set(XUserID, session.UID)
+			c.Request().Header.Set(XUserEMAIL, session.Login)
+			if perms != "" {
+				c.Request().Header.Set(XUserPermission, perms)
+			}
 		}
 
 		if err := next(c); err != nil {
@@ -106,26 +222,79 @@ func (s *Server) checkSession(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
-func (s *Server) getPermissions(ctx context.Context, session *session.Session) string {
+// getPermissions returns base64 permissions of the session subject filtered by namespace,
+// error is returned only if permissions unavailable and the on_error policy denies request
+func (s *Server) getPermissions(ctx context.Context, session *session.Session, filter string) (string, error) {
 	if s.perm == nil {
-		return ""
+		return "", nil
 	}
-	const filter string = "data.counting"
 	subject := session.UserDomain + ":subjects:" + session.UID
+	key := subject + "|" + filter
+	// loading is shared by the concurrent requests, so it mustn't be canceled with the leader request
+	load := func() (string, error) {
+		lctx, cancel := context.WithTimeout(detachedContext{ctx}, s.permTimeout)
+		defer cancel()
+		return s.findPermissions(lctx, subject, filter)
+	}
+	var (
+		perms string
+		err   error
+	)
+	if s.permCache != nil {
+		perms, err = s.permCache.Get(key, load)
+	} else {
+		perms, err = load()
+	}
+	if err == nil {
+		return perms, nil
+	}
+	s.reqLog(ctx).Errorf("find permissions for %s with filter %s, failed %s", subject, filter, err)
+	switch s.permOnError {
+	case permOnErrorDeny:
+		return "", err
+	case permOnErrorStale:
+		perms, ok := s.permCache.Stale(key)
+		if !ok {
+			return "", err
+		}
+		s.reqLog(ctx).Warnf("permissions for %s with filter %s served from stale cache", subject, filter)
+		return perms, nil
+	default:
+		return "", nil
+	}
+}
+
+// detachedContext keeps values of the parent context (request id, span), but not its deadline and cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// findPermissions requests permissions from the permission manager and makes base64 string of them
+func (s *Server) findPermissions(ctx context.Context, subject, filter string) (string, error) {
+	ctx, span := s.startSpan(ctx, "permissions.find", trace.SpanKindClient)
+	span.SetAttributes(attribute.String("permissions.filter", filter))
 	perm, err := s.perm.Find(ctx, subject, filter)
+	endSpan(span, err)
 	if err != nil {
-		s.log.Errorf("find permissions for %s with filter %s, failed %s", subject, filter, err)
-		return ""
+		return "", err
 	}
 	s.log.Debugf("got permissions %+v, makes base64 string", perm)
 	bts, err := json.Marshal(perm)
 	if err != nil {
-		s.log.Errorf("marshal permissions failed %s", err)
-		return ""
+		return "", fmt.Errorf("marshal permissions failed %w", err)
 	}
-	return b64.StdEncoding.EncodeToString(bts)
+	return b64.StdEncoding.EncodeToString(bts), nil
 }
 
+var (
+	errNoSession      = errors.New("session token not found in cookies or authorization header")
+	errSessionExpired = errors.New("session not found or expired")
+)
+
 var reBearer = regexp.MustCompile(`(?m)([Bb]earer)\s(.*)`)
 
 func (s *Server) getSessionID(c echo.Context) (string, session.TokenSource) {
@@ -166,9 +335,9 @@ func (s *Server) getSessionID(c echo.Context) (string, session.TokenSource) {
 // @Failure 500 {object} infra.ErrResponse
 // @Router /health [get]
 func (s *Server) apiHealthCheck(c echo.Context) error {
-	err := s.healthCheck()
+	err := s.healthCheck(c.Request().Context())
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrServerInternal(err))
+		return sendError(c, ErrServerInternal(err))
 	}
 	return c.JSON(http.StatusOK, OkStatus("OK"))
 }
@@ -229,11 +398,40 @@ type ResultSet struct {
 
 // ErrResponse structure for common response with some error
 type ErrResponse struct {
-	Err            error  `json:"-"`               // low-level runtime error
-	HTTPStatusCode int    `json:"-"`               // http response status code
-	StatusText     string `json:"status"`          // user-level status message
-	AppCode        int64  `json:"code,omitempty"`  // application-specific error code
-	ErrorText      string `json:"error,omitempty"` // application-level error message, for debugging
+	Err            error  `json:"-"`                    // low-level runtime error
+	HTTPStatusCode int    `json:"-"`                    // http response status code
+	StatusText     string `json:"status"`               // user-level status message
+	AppCode        int64  `json:"code,omitempty"`       // application-specific error code
+	Message        string `json:"message,omitempty"`    // localized user-level message of the code
+	ErrorText      string `json:"error,omitempty"`      // application-level error message, for debugging
+	RequestID      string `json:"request_id,omitempty"` // id of the request, X-Request-Id
+}
+
+// ProblemResponse RFC 7807 problem details, rendered instead of ErrResponse if the client accepts application/problem+json
+type ProblemResponse struct {
+	Type      string `json:"type"`                 // urn of the application error code
+	Title     string `json:"title"`                // localized message of the code
+	Status    int    `json:"status"`               // http response status code
+	Detail    string `json:"detail,omitempty"`     // application-level error message, for debugging
+	Instance  string `json:"instance,omitempty"`   // path of the request
+	Code      int64  `json:"code,omitempty"`       // application-specific error code
+	RequestID string `json:"request_id,omitempty"` // id of the request, X-Request-Id
+}
+
+// WithCode returns copy of the response with the application error code
+func (e ErrResponse) WithCode(code int64) ErrResponse {
+	e.AppCode = code
+	return e
+}
+
+// newErrResponse - wrapper for make err structure with any status code
+func newErrResponse(code int, err error) ErrResponse {
+	return ErrResponse{
+		Err:            err,
+		HTTPStatusCode: code,
+		StatusText:     http.StatusText(code),
+		ErrorText:      fmt.Sprintf("%v", err),
+	}
 }
 
 // ErrInvalidRequest - wrapper for make err structure
@@ -265,3 +463,73 @@ func ErrNotAuthorized(err error) ErrResponse {
 		ErrorText:      fmt.Sprintf("%v", err),
 	}
 }
+
+// ErrForbidden - wrapper for make err structure
+func ErrForbidden(err error) ErrResponse {
+	return ErrResponse{
+		Err:            err,
+		HTTPStatusCode: http.StatusForbidden,
+		StatusText:     http.StatusText(http.StatusForbidden),
+		ErrorText:      fmt.Sprintf("%v", err),
+	}
+}
+
+// ErrServiceUnavailable - wrapper for make err structure
+func ErrServiceUnavailable(err error) ErrResponse {
+	return ErrResponse{
+		Err:            err,
+		HTTPStatusCode: http.StatusServiceUnavailable,
+		StatusText:     http.StatusText(http.StatusServiceUnavailable),
+		ErrorText:      fmt.Sprintf("%v", err),
+	}
+}
+
+// ErrBadGateway - wrapper for make err structure
+func ErrBadGateway(err error) ErrResponse {
+	return ErrResponse{
+		Err:            err,
+		HTTPStatusCode: http.StatusBadGateway,
+		StatusText:     http.StatusText(http.StatusBadGateway),
+		ErrorText:      fmt.Sprintf("%v", err),
+	}
+}
+
+// ErrGatewayTimeout - wrapper for make err structure
+func ErrGatewayTimeout(err error) ErrResponse {
+	return ErrResponse{
+		Err:            err,
+		HTTPStatusCode: http.StatusGatewayTimeout,
+		StatusText:     http.StatusText(http.StatusGatewayTimeout),
+		ErrorText:      fmt.Sprintf("%v", err),
+	}
+}
+
+// ErrConflict - wrapper for make err structure
+func ErrConflict(err error) ErrResponse {
+	return ErrResponse{
+		Err:            err,
+		HTTPStatusCode: http.StatusConflict,
+		StatusText:     http.StatusText(http.StatusConflict),
+		ErrorText:      fmt.Sprintf("%v", err),
+	}
+}
+
+// ErrNotFound - wrapper for make err structure
+func ErrNotFound(err error) ErrResponse {
+	return ErrResponse{
+		Err:            err,
+		HTTPStatusCode: http.StatusNotFound,
+		StatusText:     http.StatusText(http.StatusNotFound),
+		ErrorText:      fmt.Sprintf("%v", err),
+	}
+}
+
+// ErrTooManyRequests - wrapper for make err structure
+func ErrTooManyRequests(err error) ErrResponse {
+	return ErrResponse{
+		Err:            err,
+		HTTPStatusCode: http.StatusTooManyRequests,
+		StatusText:     http.StatusText(http.StatusTooManyRequests),
+		ErrorText:      fmt.Sprintf("%v", err),
+	}
+}
@@ -1,13 +1,22 @@
 package infra
 
 import (
+	"context"
+	b64 "encoding/base64"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	permcache "git.countmax.ru/countmax/wda.back/internal/permissions/cache"
+	"git.countmax.ru/countmax/wda.back/internal/permissions/keto"
+	"git.countmax.ru/countmax/wda.back/internal/reqid"
 	"git.countmax.ru/countmax/wda.back/internal/session"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 	"go.uber.org/zap"
 )
 
@@ -55,3 +64,310 @@ func makeEchoContext(token string, inCookie bool) echo.Context {
 	}
 	return e.NewContext(req, rec)
 }
+
+func Test_permFilters_find(t *testing.T) {
+	pf, err := newPermFilters([]PermFilter{
+		{Path: "/v2/*", Filter: "data.common"},
+		{Path: "/v2/reports/*", Filter: "data.reports"},
+		{Path: "/v2/layouts/*", Filter: "data.counting"},
+		{Path: "/v2/reports", Filter: "data.reports.list"},
+		{Path: "/v2/monitoring/*", Filter: "data.monitoring"},
+	}, defaultPermFilter)
+	if err != nil {
+		t.Fatalf("newPermFilters() error = %v", err)
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/v2/layouts/1", "data.counting"},
+		{"/v2/reports/daily", "data.reports"},
+		{"/v2/reports", "data.reports.list"},
+		{"/v2/monitoring", "data.monitoring"},
+		{"/v2/monitoringx", "data.common"},
+		{"/v1/users", defaultPermFilter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := pf.find(tt.path); got != tt.want {
+				t.Errorf("permFilters.find(%s) = %s, want %s", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_hasRelation(t *testing.T) {
+	tuples := b64.StdEncoding.EncodeToString(
+		[]byte(`[{"namespace":"data.counting","object":"layouts","relation":"view"}]`))
+	listResp := b64.StdEncoding.EncodeToString(
+		[]byte(`{"relation_tuples":[{"namespace":"data.counting","object":"layouts","relation":"edit"}]}`))
+	tests := []struct {
+		name      string
+		perms     string
+		namespace string
+		relation  string
+		want      bool
+		wantErr   bool
+	}{
+		{"tuples_allowed", tuples, "data.counting", "view", true, false},
+		{"tuples_denied", tuples, "data.counting", "edit", false, false},
+		{"other_namespace", tuples, "data.monitoring", "view", false, false},
+		{"list_allowed", listResp, "data.counting", "edit", true, false},
+		{"empty", "", "data.counting", "view", false, false},
+		{"broken", "!!!", "data.counting", "view", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := hasRelation(tt.perms, tt.namespace, "layouts", tt.relation)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("hasRelation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("hasRelation() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type fakeSessManager struct {
+	session.ManagerInterface
+	sess *session.Session
+}
+
+func (f fakeSessManager) Check(context.Context, *session.ID) *session.Session {
+	return f.sess
+}
+
+func TestServer_stripIdentityHeaders(t *testing.T) {
+	got := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	upURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		log:          zap.NewNop().Sugar(),
+		sess:         fakeSessManager{sess: &session.Session{UID: "trusted-uid", Login: "trusted@login"}},
+		stripHeaders: []string{XUserID, XUserEMAIL, XUserPermission},
+	}
+	e := echo.New()
+	v2 := e.Group("/v2")
+	v2.Use(s.stripIdentityHeaders)
+	v2.Use(s.checkSession)
+	v2.Use(middleware.Proxy(middleware.NewRoundRobinBalancer([]*middleware.ProxyTarget{{URL: upURL}})))
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/layouts", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Add(XUserID, "forged-uid")
+	req.Header.Add("x-user-email", "forged@login")
+	req.Header.Add(XUserPermission, "Zm9yZ2Vk")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("proxy response code = %d, want %d", rec.Code, http.StatusOK)
+	}
+	h := <-got
+	if v := h.Values(XUserID); len(v) != 1 || v[0] != "trusted-uid" {
+		t.Errorf("upstream %s = %v, want [trusted-uid]", XUserID, v)
+	}
+	if v := h.Values(XUserEMAIL); len(v) != 1 || v[0] != "trusted@login" {
+		t.Errorf("upstream %s = %v, want [trusted@login]", XUserEMAIL, v)
+	}
+	if v := h.Values(XUserPermission); len(v) != 0 {
+		t.Errorf("upstream %s = %v, want none", XUserPermission, v)
+	}
+}
+
+func TestServer_stripIdentityHeaders_emptyFirst(t *testing.T) {
+	s := &Server{log: zap.NewNop().Sugar(), stripHeaders: []string{XUserPermission}}
+	req := httptest.NewRequest(http.MethodGet, "/v2/layouts", nil)
+	req.Header.Add(XUserPermission, "")
+	req.Header.Add(XUserPermission, "Zm9yZ2Vk")
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	h := s.stripIdentityHeaders(func(c echo.Context) error {
+		if v := c.Request().Header.Values(XUserPermission); len(v) != 0 {
+			t.Errorf("%s = %v after strip, want none", XUserPermission, v)
+		}
+		return nil
+	})
+	if err := h(c); err != nil {
+		t.Fatalf("stripIdentityHeaders() error = %v", err)
+	}
+}
+
+func TestServer_customHTTPErrorHandler(t *testing.T) {
+	s := &Server{log: zap.NewNop().Sugar()}
+	e := echo.New()
+	e.HTTPErrorHandler = s.customHTTPErrorHandler
+	e.Use(middleware.RequestID())
+	e.GET("/v1/users", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	tests := []struct {
+		name     string
+		method   string
+		uri      string
+		accept   string
+		wantCode int
+		wantJSON bool
+	}{
+		{"api_not_found", http.MethodGet, "/v1/userz", echo.MIMETextHTML, http.StatusNotFound, true},
+		{"api_method_not_allowed", http.MethodPatch, "/v1/users", echo.MIMEApplicationJSON, http.StatusMethodNotAllowed, true},
+		{"asset_not_found", http.MethodGet, "/js/app.js", "*/*", http.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.uri, nil)
+			req.Header.Set(echo.HeaderAccept, tt.accept)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("response code = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if !tt.wantJSON {
+				return
+			}
+			resp := ErrResponse{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("response isn't ErrResponse json, %v", err)
+			}
+			if resp.StatusText != http.StatusText(tt.wantCode) {
+				t.Errorf("ErrResponse.StatusText = %s, want %s", resp.StatusText, http.StatusText(tt.wantCode))
+			}
+			if resp.RequestID == "" || resp.RequestID != rec.Header().Get(echo.HeaderXRequestID) {
+				t.Errorf("ErrResponse.RequestID = %q, want X-Request-Id %q", resp.RequestID, rec.Header().Get(echo.HeaderXRequestID))
+			}
+		})
+	}
+}
+
+func TestServer_requestContext(t *testing.T) {
+	s := &Server{log: zap.NewNop().Sugar()}
+	e := echo.New()
+	e.Use(middleware.RequestID())
+	e.Use(s.requestContext)
+	var gotHeader, gotCtx string
+	e.GET("/v2/layouts", func(c echo.Context) error {
+		gotHeader = c.Request().Header.Get(echo.HeaderXRequestID)
+		gotCtx = reqid.FromContext(c.Request().Context())
+		return c.NoContent(http.StatusOK)
+	})
+	tests := []struct {
+		name    string
+		client  string
+		replace bool
+	}{
+		{"generated", "", false},
+		{"client_supplied", "client-req-1", false},
+		{"invalid", "req\nforged", true},
+		{"too_long", strings.Repeat("a", reqid.MaxLen+1), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v2/layouts", nil)
+			if tt.client != "" {
+				req.Header.Set(echo.HeaderXRequestID, tt.client)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			want := rec.Header().Get(echo.HeaderXRequestID)
+			if !reqid.Valid(want) || (tt.client != "" && (want == tt.client) == tt.replace) {
+				t.Fatalf("response X-Request-Id = %q, client %q", want, tt.client)
+			}
+			if gotHeader != want || gotCtx != want {
+				t.Errorf("request header, context id = %q, %q, want %q", gotHeader, gotCtx, want)
+			}
+		})
+	}
+}
+
+func Test_detachedContext(t *testing.T) {
+	parent, cancel := context.WithTimeout(reqid.NewContext(context.Background(), "rid"), time.Millisecond)
+	cancel()
+	ctx := detachedContext{parent}
+	if err := ctx.Err(); err != nil {
+		t.Errorf("detachedContext.Err() = %v, want nil", err)
+	}
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("detachedContext.Deadline() must be unset")
+	}
+	if got := reqid.FromContext(ctx); got != "rid" {
+		t.Errorf("detachedContext must keep values, request id = %q", got)
+	}
+}
+
+func TestServer_checkSession_permOnError(t *testing.T) {
+	// keto is unavailable, every lookup fails
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	km, err := keto.New(down.URL, time.Second, zap.NewNop().Sugar(), httpDuration)
+	if err != nil {
+		t.Fatalf("keto.New() error = %v", err)
+	}
+	const (
+		ttl    = time.Minute
+		maxAge = 10 * time.Minute
+		perms  = "c3RhbGU="
+		key    = "countmax:subjects:1|" + defaultPermFilter
+	)
+	tests := []struct {
+		name      string
+		policy    string
+		age       time.Duration // age of the cached permissions, 0 - not cached
+		wantCode  int
+		wantPerms string
+	}{
+		{"deny", permOnErrorDeny, 0, http.StatusServiceUnavailable, ""},
+		{"allow_empty", permOnErrorEmpty, 0, http.StatusOK, ""},
+		{"stale_in_max_age", permOnErrorStale, 5 * time.Minute, http.StatusOK, perms},
+		{"stale_after_max_age", permOnErrorStale, 11 * time.Minute, http.StatusServiceUnavailable, ""},
+		{"stale_not_cached", permOnErrorStale, 0, http.StatusServiceUnavailable, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			pc := permcache.New(ttl, maxAge, 10)
+			pc.SetClock(func() time.Time { return now })
+			if tt.age > 0 {
+				_, _ = pc.Get(key, func() (string, error) { return perms, nil })
+				now = now.Add(tt.age)
+			}
+			s := &Server{
+				log:         zap.NewNop().Sugar(),
+				sess:        fakeSessManager{sess: &session.Session{UID: "1", UserDomain: "countmax"}},
+				perm:        km,
+				permCache:   pc,
+				permTimeout: time.Second,
+				permOnError: tt.policy,
+			}
+			e := echo.New()
+			var gotPerms []string
+			e.GET("/v2/layouts", func(c echo.Context) error {
+				gotPerms = c.Request().Header.Values(XUserPermission)
+				return c.NoContent(http.StatusOK)
+			}, s.checkSession)
+			req := httptest.NewRequest(http.MethodGet, "/v2/layouts", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("response code = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				got := ErrResponse{}
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got.AppCode != CodePermissionsUnavailable {
+					t.Errorf("response = %s, want ErrResponse with code %d", rec.Body.String(), CodePermissionsUnavailable)
+				}
+				return
+			}
+			if tt.wantPerms == "" && len(gotPerms) != 0 {
+				t.Errorf("upstream %s = %v, want none", XUserPermission, gotPerms)
+			}
+			if tt.wantPerms != "" && (len(gotPerms) != 1 || gotPerms[0] != tt.wantPerms) {
+				t.Errorf("upstream %s = %v, want [%s]", XUserPermission, gotPerms, tt.wantPerms)
+			}
+		})
+	}
+}
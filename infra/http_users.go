@@ -0,0 +1,257 @@
+package infra
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"git.countmax.ru/countmax/wda.back/domain"
+	"git.countmax.ru/countmax/wda.back/repos"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	errUserNotFound  = errors.New("user not found")
+	errEmptyLogin    = errors.New("login must be specified")
+	errEmptyPassword = errors.New("password must be specified")
+)
+
+// UsersResponse list of users with paging metadata
+type UsersResponse struct {
+	Metadata Metadata     `json:"metadata"`
+	Users    domain.Users `json:"data"`
+}
+
+// PassRequest body of the change password request
+type PassRequest struct {
+	Password string `json:"password"`
+}
+
+// apiGetUsers docs
+// @Summary Get users
+// @Description get list of users with paging
+// @Produce  json
+// @Tags users
+// @Param offset query int false "offset of the first record, default 0"
+// @Param limit query int false "max count of records, default 10, at most 1000"
+// @Success 200 {object} infra.UsersResponse
+// @Failure 400 {object} infra.ErrResponse
+// @Failure 401 {object} infra.ErrResponse
+// @Failure 500 {object} infra.ErrResponse
+// @Router /v1/users [get]
+func (s *Server) apiGetUsers(c echo.Context) error {
+	offset, limit, err := getPaging(c)
+	if err != nil {
+		return sendError(c, ErrInvalidRequest(err))
+	}
+	ctx, span := s.repoSpan(c, "GetUsers")
+	users, total, err := s.repo.GetUsers(ctx, offset, limit)
+	endSpan(span, err)
+	if err != nil {
+		s.reqLog(c.Request().Context()).Errorf("repo.GetUsers(%d, %d) error, %v", offset, limit, err)
+		return sendError(c, ErrServerInternal(err).WithCode(CodeRepoUnavailable))
+	}
+	if users == nil {
+		users = domain.Users{}
+	}
+	for i := range users {
+		hideSecrets(&users[i])
+	}
+	return c.JSON(http.StatusOK, UsersResponse{
+		Metadata: Metadata{
+			ResultSet: ResultSet{
+				Count:  int64(len(users)),
+				Offset: offset,
+				Limit:  limit,
+				Total:  total,
+			},
+		},
+		Users: users,
+	})
+}
+
+// apiGetUser docs
+// @Summary Get user by id
+// @Description get user by user id
+// @Produce  json
+// @Tags users
+// @Param id path int true "user id"
+// @Success 200 {object} domain.User
+// @Failure 400 {object} infra.ErrResponse
+// @Failure 401 {object} infra.ErrResponse
+// @Failure 404 {object} infra.ErrResponse
+// @Failure 500 {object} infra.ErrResponse
+// @Router /v1/users/{id} [get]
+func (s *Server) apiGetUser(c echo.Context) error {
+	id, err := getUserID(c)
+	if err != nil {
+		return sendError(c, ErrInvalidRequest(err))
+	}
+	ctx, span := s.repoSpan(c, "GetUserByID")
+	u, err := s.repo.GetUserByID(ctx, id)
+	endSpan(span, err)
+	if err != nil {
+		s.reqLog(c.Request().Context()).Errorf("repo.GetUserByID(%d) error, %v", id, err)
+		return sendError(c, ErrServerInternal(err).WithCode(CodeRepoUnavailable))
+	}
+	if u == nil {
+		return sendError(c, ErrNotFound(errUserNotFound).WithCode(CodeUserNotFound))
+	}
+	hideSecrets(u)
+	return c.JSON(http.StatusOK, u)
+}
+
+// apiAddUser docs
+// @Summary Add user
+// @Description create new user
+// @Accept  json
+// @Produce  json
+// @Tags users
+// @Param user body domain.User true "user properties, login and pword are required"
+// @Success 201 {object} domain.User
+// @Failure 400 {object} infra.ErrResponse
+// @Failure 401 {object} infra.ErrResponse
+// @Failure 409 {object} infra.ErrResponse
+// @Failure 500 {object} infra.ErrResponse
+// @Router /v1/users [post]
+func (s *Server) apiAddUser(c echo.Context) error {
+	u := domain.User{}
+	if err := c.Bind(&u); err != nil {
+		return sendError(c, ErrInvalidRequest(err))
+	}
+	if u.Login == "" {
+		return sendError(c, ErrInvalidRequest(errEmptyLogin))
+	}
+	if u.PWord == "" {
+		return sendError(c, ErrInvalidRequest(errEmptyPassword))
+	}
+	ctx, span := s.repoSpan(c, "AddUser")
+	nu, err := s.repo.AddUser(ctx, u)
+	endSpan(span, err)
+	if errors.Is(err, repos.ErrLoginExists) {
+		return sendError(c, ErrConflict(err).WithCode(CodeLoginExists))
+	}
+	if err != nil {
+		s.reqLog(c.Request().Context()).Errorf("repo.AddUser(%s) error, %v", u.Login, err)
+		return sendError(c, ErrServerInternal(err).WithCode(CodeRepoUnavailable))
+	}
+	hideSecrets(nu)
+	return c.JSON(http.StatusCreated, nu)
+}
+
+// apiDelUser docs
+// @Summary Delete user
+// @Description delete user by user id
+// @Produce  json
+// @Tags users
+// @Param id path int true "user id"
+// @Success 200 {object} infra.SuccessResponse
+// @Failure 400 {object} infra.ErrResponse
+// @Failure 401 {object} infra.ErrResponse
+// @Failure 404 {object} infra.ErrResponse
+// @Failure 500 {object} infra.ErrResponse
+// @Router /v1/users/{id} [delete]
+func (s *Server) apiDelUser(c echo.Context) error {
+	id, err := getUserID(c)
+	if err != nil {
+		return sendError(c, ErrInvalidRequest(err))
+	}
+	ctx, span := s.repoSpan(c, "GetUserByID")
+	u, err := s.repo.GetUserByID(ctx, id)
+	endSpan(span, err)
+	if err != nil {
+		s.reqLog(c.Request().Context()).Errorf("repo.GetUserByID(%d) error, %v", id, err)
+		return sendError(c, ErrServerInternal(err).WithCode(CodeRepoUnavailable))
+	}
+	if u == nil {
+		return sendError(c, ErrNotFound(errUserNotFound).WithCode(CodeUserNotFound))
+	}
+	ctx, span = s.repoSpan(c, "DelUser")
+	err = s.repo.DelUser(ctx, id)
+	endSpan(span, err)
+	if err != nil {
+		s.reqLog(c.Request().Context()).Errorf("repo.DelUser(%d) error, %v", id, err)
+		return sendError(c, ErrServerInternal(err).WithCode(CodeRepoUnavailable))
+	}
+	return c.JSON(http.StatusOK, OkStatus(fmt.Sprintf("user %d deleted", id)))
+}
+
+// apiUserSetPass docs
+// @Summary Set user password
+// @Description change password for specified user
+// @Accept  json
+// @Produce  json
+// @Tags users
+// @Param id path int true "user id"
+// @Param password body infra.PassRequest true "new password"
+// @Success 200 {object} infra.SuccessResponse
+// @Failure 400 {object} infra.ErrResponse
+// @Failure 401 {object} infra.ErrResponse
+// @Failure 404 {object} infra.ErrResponse
+// @Failure 500 {object} infra.ErrResponse
+// @Router /v1/users/{id}/password [put]
+func (s *Server) apiUserSetPass(c echo.Context) error {
+	id, err := getUserID(c)
+	if err != nil {
+		return sendError(c, ErrInvalidRequest(err))
+	}
+	req := PassRequest{}
+	if err := c.Bind(&req); err != nil {
+		return sendError(c, ErrInvalidRequest(err))
+	}
+	if req.Password == "" {
+		return sendError(c, ErrInvalidRequest(errEmptyPassword))
+	}
+	ctx, span := s.repoSpan(c, "GetUserByID")
+	u, err := s.repo.GetUserByID(ctx, id)
+	endSpan(span, err)
+	if err != nil {
+		s.reqLog(c.Request().Context()).Errorf("repo.GetUserByID(%d) error, %v", id, err)
+		return sendError(c, ErrServerInternal(err).WithCode(CodeRepoUnavailable))
+	}
+	if u == nil {
+		return sendError(c, ErrNotFound(errUserNotFound).WithCode(CodeUserNotFound))
+	}
+	ctx, span = s.repoSpan(c, "UserSetPass")
+	err = s.repo.UserSetPass(ctx, id, req.Password)
+	endSpan(span, err)
+	if err != nil {
+		s.reqLog(c.Request().Context()).Errorf("repo.UserSetPass(%d) error, %v", id, err)
+		return sendError(c, ErrServerInternal(err).WithCode(CodeRepoUnavailable))
+	}
+	return c.JSON(http.StatusOK, OkStatus(fmt.Sprintf("password for user %d changed", id)))
+}
+
+// hideSecrets clears password of the user and password of its mailbox before the user is sent to the client
+func hideSecrets(u *domain.User) {
+	u.PWord = ""
+	u.EMailPWord = ""
+}
+
+// getUserID extracts user id from the path parameter
+func getUserID(c echo.Context) (int64, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad user id %q, %w", c.Param("id"), err)
+	}
+	return id, nil
+}
+
+// getPaging extracts offset & limit from the query, limit is PAGESIZE by default and MAXPAGESIZE at most
+func getPaging(c echo.Context) (offset, limit int64, err error) {
+	limit = int64(PAGESIZE)
+	if v := c.QueryParam("offset"); v != "" {
+		offset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("bad offset %q, must be non negative integer", v)
+		}
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || limit <= 0 || limit > int64(MAXPAGESIZE) {
+			return 0, 0, fmt.Errorf("bad limit %q, must be positive integer not greater than %d", v, MAXPAGESIZE)
+		}
+	}
+	return offset, limit, nil
+}
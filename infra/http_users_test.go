@@ -0,0 +1,178 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.countmax.ru/countmax/wda.back/domain"
+	"git.countmax.ru/countmax/wda.back/internal/session/local"
+	"git.countmax.ru/countmax/wda.back/repos"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+func newUsersTestServer() (*Server, *echo.Echo) {
+	repo, _ := repos.NewMemRepo()
+	s := &Server{log: zap.NewNop().Sugar(), repo: repo}
+	e := echo.New()
+	e.GET("/v1/users", s.apiGetUsers)
+	e.POST("/v1/users", s.apiAddUser)
+	e.GET("/v1/users/:id", s.apiGetUser)
+	e.DELETE("/v1/users/:id", s.apiDelUser)
+	e.PUT("/v1/users/:id/password", s.apiUserSetPass)
+	e.POST("/v1/auth/login", s.apiLogin)
+	return s, e
+}
+
+func doJSON(e *echo.Echo, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServer_apiUsers(t *testing.T) {
+	_, e := newUsersTestServer()
+	for _, login := range []string{"ivanov", "petrov", "sidorov"} {
+		rec := doJSON(e, http.MethodPost, "/v1/users", `{"login":"`+login+`","pword":"s3cret","email_password":"m41l"}`)
+		if rec.Code != http.StatusCreated || strings.Contains(rec.Body.String(), "s3cret") || strings.Contains(rec.Body.String(), "m41l") {
+			t.Fatalf("POST /v1/users = %d %s, want 201 without pword and email_password", rec.Code, rec.Body.String())
+		}
+	}
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		wantCode int
+		wantApp  int64
+	}{
+		{"get", http.MethodGet, "/v1/users/2", "", http.StatusOK, 0},
+		{"get_not_found", http.MethodGet, "/v1/users/42", "", http.StatusNotFound, CodeUserNotFound},
+		{"list_limit_too_big", http.MethodGet, "/v1/users?offset=1&limit=9223372036854775807", "", http.StatusBadRequest, CodeValidation},
+		{"get_bad_id", http.MethodGet, "/v1/users/x", "", http.StatusBadRequest, CodeValidation},
+		{"add_without_pass", http.MethodPost, "/v1/users", `{"login":"kuznetsov"}`, http.StatusBadRequest, CodeValidation},
+		{"add_same_login", http.MethodPost, "/v1/users", `{"login":"ivanov","pword":"x"}`, http.StatusConflict, CodeLoginExists},
+		{"set_pass_not_found", http.MethodPut, "/v1/users/42/password", `{"password":"n3w"}`, http.StatusNotFound, CodeUserNotFound},
+		{"set_pass", http.MethodPut, "/v1/users/1/password", `{"password":"n3w"}`, http.StatusOK, 0},
+		{"del", http.MethodDelete, "/v1/users/3", "", http.StatusOK, 0},
+		{"del_again", http.MethodDelete, "/v1/users/3", "", http.StatusNotFound, CodeUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doJSON(e, tt.method, tt.target, tt.body)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("%s %s = %d %s, want %d", tt.method, tt.target, rec.Code, rec.Body.String(), tt.wantCode)
+			}
+			if tt.wantApp == 0 {
+				return
+			}
+			got := ErrResponse{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("response isn't ErrResponse json, %v", err)
+			}
+			if got.AppCode != tt.wantApp {
+				t.Errorf("ErrResponse code = %d, want %d", got.AppCode, tt.wantApp)
+			}
+		})
+	}
+
+	rec := doJSON(e, http.MethodGet, "/v1/users?offset=1&limit=5", "")
+	got := UsersResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("GET /v1/users isn't UsersResponse json, %v", err)
+	}
+	rs := got.Metadata.ResultSet
+	if rec.Code != http.StatusOK || rs.Count != 1 || rs.Total != 2 || rs.Offset != 1 || rs.Limit != 5 {
+		t.Errorf("GET /v1/users = %d %+v, want 1 of 2 users", rec.Code, rs)
+	}
+	if len(got.Users) != 1 || got.Users[0].Login != "petrov" || got.Users[0].EMailPWord != "" {
+		t.Errorf("GET /v1/users data = %+v, want petrov without email_password", got.Users)
+	}
+	if rec := doJSON(e, http.MethodGet, "/v1/users/2", ""); strings.Contains(rec.Body.String(), "m41l") {
+		t.Errorf("GET /v1/users/2 = %s, want without email_password", rec.Body.String())
+	}
+}
+
+func TestServer_apiLogin_wrongPass(t *testing.T) {
+	s, e := newUsersTestServer()
+	if _, err := s.repo.AddUser(context.Background(), domain.User{Login: "ivanov", PWord: "s3cret"}); err != nil {
+		t.Fatalf("AddUser() error = %v", err)
+	}
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantApp  int64
+	}{
+		{"empty", `{"login":"ivanov"}`, http.StatusBadRequest, CodeValidation},
+		{"wrong_pass", `{"login":"ivanov","password":"wrong"}`, http.StatusUnauthorized, CodeLoginPass},
+		{"unknown_login", `{"login":"petrov","password":"s3cret"}`, http.StatusUnauthorized, CodeLoginPass},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doJSON(e, http.MethodPost, "/v1/auth/login", tt.body)
+			got := ErrResponse{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("response isn't ErrResponse json, %v", err)
+			}
+			if rec.Code != tt.wantCode || got.AppCode != tt.wantApp {
+				t.Errorf("POST /v1/auth/login = %d code %d, want %d code %d", rec.Code, got.AppCode, tt.wantCode, tt.wantApp)
+			}
+		})
+	}
+}
+
+func TestServer_apiLogin(t *testing.T) {
+	tests := []struct {
+		name         string
+		tokenInBody  bool
+		cookieSecure bool
+	}{
+		{"cookie_only", false, false},
+		{"token_in_body", true, false},
+		{"secure_cookie", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, e := newUsersTestServer()
+			s.localSess = local.New(nil, time.Hour)
+			s.tokenInBody = tt.tokenInBody
+			s.cookieSecure = tt.cookieSecure
+			if _, err := s.repo.AddUser(context.Background(), domain.User{Login: "ivanov", PWord: "s3cret", EMailPWord: "m41l"}); err != nil {
+				t.Fatalf("AddUser() error = %v", err)
+			}
+			rec := doJSON(e, http.MethodPost, "/v1/auth/login", `{"login":"ivanov","password":"s3cret"}`)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("POST /v1/auth/login = %d %s, want 200", rec.Code, rec.Body.String())
+			}
+			if body := rec.Body.String(); strings.Contains(body, "s3cret") || strings.Contains(body, "m41l") || strings.Contains(body, "pword") {
+				t.Errorf("POST /v1/auth/login = %s, want user without passwords", body)
+			}
+			cookies := rec.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Name != sessCookieID || cookies[0].Value == "" {
+				t.Fatalf("POST /v1/auth/login cookies = %v, want session cookie", cookies)
+			}
+			if cookies[0].Secure != tt.cookieSecure {
+				t.Errorf("session cookie secure = %t, want %t", cookies[0].Secure, tt.cookieSecure)
+			}
+			got := LoginResponse{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("response isn't LoginResponse json, %v", err)
+			}
+			wantToken := ""
+			if tt.tokenInBody {
+				wantToken = cookies[0].Value
+			}
+			if got.Token != wantToken {
+				t.Errorf("LoginResponse token = %q, want %q", got.Token, wantToken)
+			}
+		})
+	}
+}
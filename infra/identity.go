@@ -0,0 +1,77 @@
+package infra
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"git.countmax.ru/countmax/wda.back/identity"
+	"git.countmax.ru/countmax/wda.back/internal/session"
+)
+
+const defaultIdentityTTL time.Duration = time.Minute
+
+// setIdentitySigner makes signer of the identity token for upstream if it is enabled
+func (s *Server) setIdentitySigner() error {
+	if !s.config.GetBool("identity.enabled") {
+		return nil
+	}
+	kid := s.config.GetString("identity.kid")
+	alg := s.config.GetString("identity.alg")
+	secret := []byte(s.config.GetString("identity.key"))
+	if keyFile := s.config.GetString("identity.key_file"); keyFile != "" {
+		bts, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return fmt.Errorf("read identity.key_file error, %w", err)
+		}
+		secret = bts
+	}
+	if len(secret) == 0 {
+		return errors.New("identity.key or identity.key_file must be specified")
+	}
+	var key identity.Key
+	switch alg {
+	case identity.AlgHS256, "":
+		key = identity.NewHS256Key(kid, secret)
+	case identity.AlgEdDSA:
+		k, err := identity.ParseEdDSAKeyPEM(kid, secret)
+		if err != nil {
+			return fmt.Errorf("parse identity EdDSA key error, %w", err)
+		}
+		key = k
+	default:
+		return fmt.Errorf("unsupported identity.alg %s", alg)
+	}
+	s.idHeader = s.config.GetString("identity.header")
+	if s.idHeader == "" {
+		s.idHeader = identity.Header
+	}
+	ttl := s.config.GetDuration("identity.ttl")
+	if ttl <= 0 {
+		ttl = defaultIdentityTTL
+	}
+	issuer := s.config.GetString("identity.issuer")
+	s.idSigner = identity.NewSigner(key, issuer, ttl)
+	s.log.Infof("identity token enabled, header=%s, alg=%s, kid=%s, ttl=%s", s.idHeader, key.Alg, kid, ttl)
+	return nil
+}
+
+// signIdentity makes identity token of the session with base64 permissions
+func (s *Server) signIdentity(sess *session.Session, perms string) (string, error) {
+	claims := identity.Claims{
+		UID:    sess.UID,
+		Login:  sess.Login,
+		Domain: sess.UserDomain,
+	}
+	if perms != "" {
+		bts, err := b64.StdEncoding.DecodeString(perms)
+		if err != nil {
+			return "", fmt.Errorf("decode permissions error, %w", err)
+		}
+		claims.Permissions = json.RawMessage(bts)
+	}
+	return s.idSigner.Sign(claims)
+}
@@ -21,4 +21,36 @@ var (
 		},
 		[]string{"url", "code", "method"},
 	)
+
+	sessCacheLookups = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "session_cache_lookups_total",
+			Help: "Count of session cache lookups by result: hit or miss",
+		},
+		[]string{"result"},
+	)
+
+	upstreamCircuit = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "upstream_circuit_state",
+			Help: "State of the upstream target circuit breaker: 0 closed, 1 half-open, 2 open",
+		},
+		[]string{"route", "target"},
+	)
+
+	upstreamRetries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_retries_total",
+			Help: "Count of the proxied requests retried against another upstream target",
+		},
+		[]string{"route", "from", "to"},
+	)
+
+	rateLimited = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ratelimit_rejected_total",
+			Help: "Count of the requests rejected by the rate limit by route group",
+		},
+		[]string{"group"},
+	)
 )
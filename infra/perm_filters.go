@@ -0,0 +1,97 @@
+package infra
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const defaultPermFilter string = "data.counting"
+
+// PermFilter maps request path pattern to the permissions namespace,
+// path ended with * matches by prefix, /prefix/* matches /prefix too, otherwise matches exactly
+type PermFilter struct {
+	Path   string `mapstructure:"path"`
+	Filter string `mapstructure:"filter"`
+}
+
+// permFilters list of the filters sorted from most specific pattern to the least one
+type permFilters struct {
+	items []PermFilter
+	def   string
+}
+
+func newPermFilters(items []PermFilter, def string) (*permFilters, error) {
+	for _, f := range items {
+		if f.Path == "" || f.Filter == "" {
+			return nil, fmt.Errorf("bad permissions filter %+v, path and filter must be specified", f)
+		}
+		if err := checkPathPattern(f.Path); err != nil {
+			return nil, err
+		}
+	}
+	if def == "" {
+		return nil, errors.New("default permissions filter must be specified")
+	}
+	sorted := make([]PermFilter, len(items))
+	copy(sorted, items)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(strings.TrimSuffix(sorted[i].Path, "*")) > len(strings.TrimSuffix(sorted[j].Path, "*"))
+	})
+	return &permFilters{items: sorted, def: def}, nil
+}
+
+// find returns permissions namespace for the request path, exact pattern wins over the prefix ones
+func (pf *permFilters) find(path string) string {
+	if pf == nil {
+		return defaultPermFilter
+	}
+	for _, f := range pf.items {
+		if f.Path == path {
+			return f.Filter
+		}
+	}
+	for _, f := range pf.items {
+		if matchPath(f.Path, path) {
+			return f.Filter
+		}
+	}
+	return pf.def
+}
+
+// matchPath checks path by the pattern, pattern ended with * matches by prefix,
+// pattern /prefix/* matches /prefix itself too
+func matchPath(pattern, path string) bool {
+	if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+		return strings.HasPrefix(path, prefix) ||
+			(strings.HasSuffix(prefix, "/") && path == strings.TrimSuffix(prefix, "/"))
+	}
+	return path == pattern
+}
+
+// checkPathPattern validates pattern, * allowed only at the end
+func checkPathPattern(pattern string) error {
+	if i := strings.Index(pattern, "*"); i >= 0 && i != len(pattern)-1 {
+		return fmt.Errorf("bad path pattern %s, * allowed only at the end", pattern)
+	}
+	return nil
+}
+
+// setPermFilters reads route to permissions namespace map from the config
+func (s *Server) setPermFilters() error {
+	var items []PermFilter
+	if err := s.config.UnmarshalKey("permissions.filters", &items); err != nil {
+		return fmt.Errorf("read permissions.filters error, %w", err)
+	}
+	def := s.config.GetString("permissions.default_filter")
+	if def == "" {
+		def = defaultPermFilter
+	}
+	pf, err := newPermFilters(items, def)
+	if err != nil {
+		return err
+	}
+	s.permFilters = pf
+	return nil
+}
@@ -0,0 +1,117 @@
+package infra
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"git.countmax.ru/countmax/wda.back/internal/ratelimit"
+	"git.countmax.ru/countmax/wda.back/internal/session"
+	"github.com/labstack/echo/v4"
+)
+
+const headerRetryAfter string = "Retry-After"
+
+var errTooManyRequests = errors.New("rate limit exceeded, try again later")
+
+// RateLimitConfig token bucket limit of the route group
+type RateLimitConfig struct {
+	Group string  `mapstructure:"group"` // v1 or name of the proxy route
+	RPS   float64 `mapstructure:"rps"`   // requests per second, 0 - without limit
+	Burst int     `mapstructure:"burst"` // max requests at once, rps if not defined
+}
+
+// setRateLimits makes limiters for the route groups, groups without own limit use ratelimit.rps & ratelimit.burst
+func (s *Server) setRateLimits() error {
+	if !s.config.GetBool("ratelimit.enabled") {
+		return nil
+	}
+	var cfgs []RateLimitConfig
+	if err := s.config.UnmarshalKey("ratelimit.groups", &cfgs); err != nil {
+		return fmt.Errorf("read ratelimit.groups error, %w", err)
+	}
+	s.rateLimits = make(map[string]RateLimitConfig, len(cfgs))
+	for _, cfg := range cfgs {
+		if cfg.Group == "" {
+			return fmt.Errorf("bad rate limit %+v, group must be specified", cfg)
+		}
+		if cfg.RPS < 0 || cfg.Burst < 0 {
+			return fmt.Errorf("bad rate limit of the group %s, rps and burst must be non negative", cfg.Group)
+		}
+		s.rateLimits[cfg.Group] = cfg
+	}
+	s.rateLimitDef = RateLimitConfig{
+		RPS:   s.config.GetFloat64("ratelimit.rps"),
+		Burst: s.config.GetInt("ratelimit.burst"),
+	}
+	s.rateLimitByIP = RateLimitConfig{
+		RPS:   s.config.GetFloat64("ratelimit.ip_rps"),
+		Burst: s.config.GetInt("ratelimit.ip_burst"),
+	}
+	if s.rateLimitByIP.RPS < 0 || s.rateLimitByIP.Burst < 0 {
+		return errors.New("ratelimit.ip_rps and ratelimit.ip_burst must be non negative")
+	}
+	s.log.Infof("rate limits enabled, default rps=%g burst=%d, ip rps=%g burst=%d, groups %+v",
+		s.rateLimitDef.RPS, s.rateLimitDef.Burst, s.rateLimitByIP.RPS, s.rateLimitByIP.Burst, cfgs)
+	return nil
+}
+
+// rateLimit returns middleware limits requests of the group by session uid,
+// client ip is used if there is no session, so it must be used after checkSession on authorized routes
+func (s *Server) rateLimit(group string) echo.MiddlewareFunc {
+	cfg, ok := s.rateLimits[group]
+	if !ok {
+		cfg = s.rateLimitDef
+	}
+	return s.limitBy(group, cfg, func(c echo.Context) string {
+		if sess, ok := c.Get(sessionKey).(*session.Session); ok && sess != nil {
+			return "uid:" + sess.UID
+		}
+		return "ip:" + c.RealIP()
+	})
+}
+
+// rateLimitIP returns middleware limits requests of the group by client ip before checkSession,
+// so requests with forged or expired sessions are limited too;
+// limit is ratelimit.ip_rps & ratelimit.ip_burst, the group limit if they aren't defined
+func (s *Server) rateLimitIP(group string) echo.MiddlewareFunc {
+	cfg := s.rateLimitByIP
+	if cfg.RPS == 0 {
+		var ok bool
+		if cfg, ok = s.rateLimits[group]; !ok {
+			cfg = s.rateLimitDef
+		}
+	}
+	return s.limitBy(group, cfg, func(c echo.Context) string {
+		return "ip:" + c.RealIP()
+	})
+}
+
+// limitBy returns middleware limits requests of the group by the key of the request
+func (s *Server) limitBy(group string, cfg RateLimitConfig, key func(c echo.Context) string) echo.MiddlewareFunc {
+	if s.rateLimits == nil || cfg.RPS <= 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		}
+	}
+	burst := cfg.Burst
+	if burst == 0 {
+		burst = int(math.Ceil(cfg.RPS))
+	}
+	l := ratelimit.New(cfg.RPS, burst)
+	s.log.Infof("rate limit of the group %s, rps=%g, burst=%d", group, cfg.RPS, burst)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := key(c)
+			allowed, wait := l.Allow(key)
+			if !allowed {
+				rateLimited.WithLabelValues(group).Inc()
+				s.reqLog(c.Request().Context()).Warnf("rate limit of the group %s exceeded by %s", group, key)
+				c.Response().Header().Set(headerRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				return sendError(c, ErrTooManyRequests(errTooManyRequests))
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package infra
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/labstack/echo/v4"
+)
+
+// setIPExtractor defines how the client ip is taken: X-Forwarded-For is trusted only
+// from the proxies of httpd.trusted_proxies, without them ip is the remote address of the connection
+func (s *Server) setIPExtractor() error {
+	cidrs := s.config.GetStringSlice("httpd.trusted_proxies")
+	if len(cidrs) == 0 {
+		s.ipExtractor = echo.ExtractIPDirect()
+		return nil
+	}
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("bad httpd.trusted_proxies %s, %w", cidr, err)
+		}
+		opts = append(opts, echo.TrustIPRange(ipNet))
+	}
+	s.ipExtractor = echo.ExtractIPFromXFFHeader(opts...)
+	s.log.Infof("client ip is taken from X-Forwarded-For of the trusted proxies %v", cidrs)
+	return nil
+}
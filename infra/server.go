@@ -5,22 +5,25 @@ package infra
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"time"
 
 	// nolint:gosec
 	_ "net/http/pprof" // for remote profiling
 
+	"git.countmax.ru/countmax/wda.back/identity"
+	"git.countmax.ru/countmax/wda.back/internal/certs"
 	"git.countmax.ru/countmax/wda.back/internal/permissions"
+	permcache "git.countmax.ru/countmax/wda.back/internal/permissions/cache"
 	"git.countmax.ru/countmax/wda.back/internal/permissions/keto"
 	"git.countmax.ru/countmax/wda.back/internal/session"
+	sesscache "git.countmax.ru/countmax/wda.back/internal/session/cache"
 	"git.countmax.ru/countmax/wda.back/internal/session/inmemory"
 	"git.countmax.ru/countmax/wda.back/internal/session/kratos"
+	"git.countmax.ru/countmax/wda.back/internal/session/local"
 
 	"git.countmax.ru/countmax/wda.back/domain"
 	"git.countmax.ru/countmax/wda.back/repos"
@@ -30,6 +33,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -42,27 +47,57 @@ const (
 	scopeUPStream     string        = "layoutconfig.api"
 	maxIdleConns      int           = 50
 	kindManagerInMem  string        = "memory"
+	defaultSessionTTL time.Duration = 24 * time.Hour
+	defaultPermTIO    time.Duration = 10 * time.Second
+	periodSessSweep   time.Duration = time.Minute
+	permOnErrorDeny   string        = "deny"
+	permOnErrorEmpty  string        = "allow-empty"
+	permOnErrorStale  string        = "stale"
 )
 
 // Server main engine
 type Server struct {
-	log         *zap.SugaredLogger
-	consul      *consulapi.Agent
-	mux         *echo.Echo
-	metricmux   *echo.Echo
-	version     string
-	githash     string
-	build       string
-	config      *viper.Viper
-	mService    *prometheus.GaugeVec
-	mAPI        *prometheus.HistogramVec
-	chCancel    <-chan struct{}
-	fnCancel    context.CancelFunc
-	sess        session.ManagerInterface
-	perm        permissions.ManagerInterface
-	repo        domain.UserRepoI
-	handler     *http.Client
-	guiSettings Settings
+	log           *zap.SugaredLogger
+	consul        *consulapi.Agent
+	mux           *echo.Echo
+	metricmux     *echo.Echo
+	version       string
+	githash       string
+	build         string
+	config        *viper.Viper
+	mService      *prometheus.GaugeVec
+	mAPI          *prometheus.HistogramVec
+	chCancel      <-chan struct{}
+	fnCancel      context.CancelFunc
+	sess          session.ManagerInterface
+	localSess     *local.Manager
+	tokenInBody   bool
+	cookieSecure  bool
+	sessCache     *sesscache.Manager
+	perm          permissions.ManagerInterface
+	permCache     *permcache.Cache
+	permTimeout   time.Duration
+	permOnError   string
+	permFilters   *permFilters
+	authzRules    []AuthzRule
+	usersAdmin    *AuthzRule
+	idSigner      *identity.Signer
+	idHeader      string
+	stripHeaders  []string
+	upstreamCerts *certs.Files
+	httpdCerts    *certs.Files
+	serviceCerts  *certs.Files
+	corsConfig    *middleware.CORSConfig
+	tracer        trace.Tracer
+	traceProvider *sdktrace.TracerProvider
+	rateLimits    map[string]RateLimitConfig
+	rateLimitDef  RateLimitConfig
+	rateLimitByIP RateLimitConfig
+	ipExtractor   echo.IPExtractor
+	repo          domain.UserRepoI
+	handler       *http.Client
+	routes        []*proxyRoute
+	guiSettings   Settings
 }
 
 // NewServer builder main document server
@@ -83,10 +118,36 @@ func NewServer(version, build, githash string) *Server {
 	if err != nil {
 		s.log.Fatalf("failed %s", err)
 	}
+	s.setSessCache()
 	err = s.setPermManager()
 	if err != nil {
 		s.log.Fatalf("failed %s", err)
 	}
+	err = s.setIdentitySigner()
+	if err != nil {
+		s.log.Fatalf("failed %s", err)
+	}
+	s.setStripHeaders()
+	err = s.setServerTLS()
+	if err != nil {
+		s.log.Fatalf("failed %s", err)
+	}
+	err = s.setIPExtractor()
+	if err != nil {
+		s.log.Fatalf("failed %s", err)
+	}
+	err = s.setCORS()
+	if err != nil {
+		s.log.Fatalf("failed %s", err)
+	}
+	err = s.setTracer()
+	if err != nil {
+		s.log.Fatalf("failed %s", err)
+	}
+	err = s.setRateLimits()
+	if err != nil {
+		s.log.Fatalf("failed %s", err)
+	}
 	//
 	s.mService.WithLabelValues("general", "localhost", s.version, s.githash, s.build).Set(0)
 	s.registerRepos()
@@ -103,19 +164,41 @@ func (s *Server) Run() {
 	s.chCancel = ctx.Done()
 	s.registerRoutes()
 	s.mux.HTTPErrorHandler = s.customHTTPErrorHandler
+	healthPeriod := s.config.GetDuration("proxy.health_period")
+	if healthPeriod <= 0 {
+		healthPeriod = periodHealthCheck
+	}
+	go s.upstreamsChecker(healthPeriod, s.chCancel)
+	if s.localSess != nil {
+		go s.localSess.Run(ctx, periodSessSweep)
+	}
+	if s.upstreamCerts != nil {
+		go s.certsReloader(ctx, "upstream", s.upstreamCerts, s.config.GetDuration("proxy.tls.reload_period"))
+	}
+	if s.httpdCerts != nil {
+		go s.certsReloader(ctx, "httpd", s.httpdCerts, s.config.GetDuration("httpd.tls.reload_period"))
+	}
+	if s.serviceCerts != nil {
+		go s.certsReloader(ctx, "httpd.service", s.serviceCerts, s.config.GetDuration("httpd.tls.reload_period"))
+	}
+	for _, r := range s.routes {
+		if r.watcher != nil {
+			go r.watcher.Run(ctx)
+		}
+	}
 
 	host := s.config.GetString("httpd.host") + ":" + s.config.GetString("httpd.port")
-	s.log.Infof("http server starting main service on the [%s] tcp port", host)
+	s.log.Infof("http server starting main service on the [%s] tcp port, tls=%t", host, s.httpdCerts != nil)
 	go func() {
-		if err := s.mux.Start(host); !errors.Is(err, http.ErrServerClosed) {
+		if err := startServer(s.mux, host, s.httpdCerts); !errors.Is(err, http.ErrServerClosed) {
 			s.log.Fatalf("http server error: %v", err)
 		}
 	}()
 	// metrics
 	hostportMetrics := s.config.GetString("httpd.host") + ":" + s.config.GetString("httpd.service.port")
-	s.log.Infof("http server starting service api on the [%s]", hostportMetrics)
+	s.log.Infof("http server starting service api on the [%s], tls=%t", hostportMetrics, s.serviceCerts != nil)
 	go func() {
-		if err := s.metricmux.Start(hostportMetrics); !errors.Is(err, http.ErrServerClosed) {
+		if err := startServer(s.metricmux, hostportMetrics, s.serviceCerts); !errors.Is(err, http.ErrServerClosed) {
 			s.log.Fatalf("http server error: %v", err)
 		}
 	}()
@@ -130,14 +213,14 @@ func (s *Server) Stop() {
 	defer cancel()
 	defer s.consulDeRegister()
 	s.fnCancel()
-	go func(ctx context.Context) {
-		if err := s.mux.Shutdown(ctx); err != nil {
-			s.log.Fatal(err)
-		}
-	}(ctx)
+	if err := s.mux.Shutdown(ctx); err != nil {
+		s.log.Fatal(err)
+	}
 	if err := s.metricmux.Shutdown(ctx); err != nil {
 		s.log.Fatal(err)
 	}
+	// spans of the finished requests are exported after the mux shutdown
+	s.stopTracer(ctx)
 }
 
 func (s *Server) registerRoutes() {
@@ -157,59 +240,108 @@ func (s *Server) registerRoutes() {
 	e := echo.New()
 	e.HidePort = true
 	e.HideBanner = true // hide banner ECHO
+	e.IPExtractor = s.ipExtractor
 	e.Use(middleware.Recover())
 	e.Use(middleware.RequestID())
+	e.Use(s.requestContext)
 	e.Use(s.customHTTPLogger)
-
-	uri := s.config.GetString("proxy.upstream")
-	url1, err := url.Parse(uri)
-	if err != nil {
-		s.log.Fatalf("parse url %s error, %v", uri, err)
+	// preflight requests are answered here, before checkSession of the routes
+	if s.corsConfig != nil {
+		e.Use(middleware.CORSWithConfig(*s.corsConfig))
 	}
+
 	proxyTimeout := s.config.GetDuration("proxy.timeout_sec") * time.Second
-	// nolint:gosec
-	cfg := &tls.Config{
-		InsecureSkipVerify: true,
+	tr, err := s.upstreamTransport()
+	if err != nil {
+		s.log.Fatalf("upstream tls error, %v", err)
 	}
 	// set timeouts and border for opened connections
-	handler := &http.Client{Timeout: proxyTimeout, Transport: &http.Transport{
-		MaxIdleConns:    maxIdleConns,
-		IdleConnTimeout: proxyTimeout,
-		TLSClientConfig: cfg,
-	}}
+	tr.MaxIdleConns = maxIdleConns
+	tr.IdleConnTimeout = proxyTimeout
+	handler := &http.Client{Timeout: proxyTimeout, Transport: tr}
 	s.handler = handler
-	// common
-	balancer := middleware.NewRoundRobinBalancer([]*middleware.ProxyTarget{
-		{
-			URL: url1,
-		},
-	})
-
-	v2 := e.Group("/" + apiVersion)
-	v2.Use(s.checkSession)
-	v2.Use(middleware.Proxy(balancer))
+	// proxied routes
+	routes, err := s.newProxyRoutes()
+	if err != nil {
+		s.log.Fatalf("make proxy routes error, %v", err)
+	}
+	s.routes = routes
+	s.registerProxyRoutes(e)
 
 	// v1
 	v1 := e.Group("/" + apiLocalVersion)
+	v1Limit := s.rateLimit(apiLocalVersion)
 	// settings
-	v1.GET("/layout/settings", s.apiSettings)
+	v1.GET("/layout/settings", s.apiSettings, v1Limit)
+	// local auth, only for the sessions issued by wda.back itself
+	if s.localSess != nil {
+		auth := v1.Group("/auth", v1Limit)
+		auth.POST("/login", s.apiLogin)
+		auth.POST("/logout", s.apiLogout)
+	}
+	// users
+	users := v1.Group("/users", s.rateLimitIP(apiLocalVersion), s.checkSession, v1Limit, s.requireRelation(s.usersAdmin))
+	users.GET("", s.apiGetUsers)
+	users.POST("", s.apiAddUser)
+	users.GET("/:id", s.apiGetUser)
+	users.DELETE("/:id", s.apiDelUser)
+	users.PUT("/:id/password", s.apiUserSetPass)
 	// static
 	e.Static("/", "web")
 	s.mux = e
 }
 
+// setStripHeaders defines identity headers which are removed from the client requests
+func (s *Server) setStripHeaders() {
+	headers := s.config.GetStringSlice("proxy.strip_headers")
+	if len(headers) == 0 {
+		headers = []string{XUserID, XUserEMAIL, XUserPermission}
+	}
+	if s.idSigner != nil {
+		headers = append(headers, s.idHeader)
+	}
+	s.stripHeaders = headers
+}
+
+// SeedUser initial user of the users.source memory from config users.seed
+type SeedUser struct {
+	Login    string `mapstructure:"login"`    // login of the user
+	Password string `mapstructure:"password"` // plain password, hashed on start
+	Name     string `mapstructure:"name"`     // full name of the user
+	Domain   string `mapstructure:"domain"`   // domain of the user
+}
+
 func (s *Server) registerRepos() {
 	s.log.Debug("start registerRepos")
 	defer s.log.Debug("finish registerRepos")
-	timeout := s.config.GetDuration("countmax.timeout_sec") * time.Second
-	dsn := s.config.GetString("countmax.url")
-
-	cmr, err := repos.NewCMRepo(dsn, timeout, s.log)
+	cfg := repos.Config{
+		Source:  s.config.GetString("users.source"),
+		DSN:     s.config.GetString("users.dsn"),
+		Timeout: s.config.GetDuration("users.timeout"),
+	}
+	seed := []SeedUser{}
+	if err := s.config.UnmarshalKey("users.seed", &seed); err != nil {
+		s.log.Fatalf("users.seed config error, %v", err)
+	}
+	for _, u := range seed {
+		cfg.Seed = append(cfg.Seed, domain.User{
+			Login:        u.Login,
+			PWord:        u.Password,
+			UserFullName: u.Name,
+			DomainName:   u.Domain,
+		})
+	}
+	if cfg.Source == "" || cfg.Source == repos.SourceCountmax {
+		cfg.DSN = s.config.GetString("countmax.url")
+		cfg.Timeout = s.config.GetDuration("countmax.timeout_sec") * time.Second
+	}
+	repo, err := repos.New(cfg, s.log)
 	if err != nil {
 		s.log.Fatalf("registerRepo by config error, %v", err)
 	}
-	s.repo = cmr
-	s.mService.WithLabelValues(scope, cmr.GetSrvPortDB(), s.version, s.githash, s.build).Set(1)
+	s.repo = repo
+	s.log.Infof("users repository %s, %s", cfg.Source, repo.GetSrvPortDB())
+	s.mService.WithLabelValues(scope, repo.GetSrvPortDB(), s.version, s.githash, s.build).Set(1)
 
 	// settings
 	proxy := s.config.GetString("layout.proxy")
@@ -233,8 +365,15 @@ func (s *Server) setSessManager() error {
 	}
 	switch sessKind {
 	case kindManagerInMem:
-		ms := inmemory.New()
+		ttl := s.config.GetDuration("session.ttl")
+		if ttl <= 0 {
+			ttl = defaultSessionTTL
+		}
+		ms := local.New(inmemory.New(), ttl)
 		s.sess = ms
+		s.localSess = ms
+		s.tokenInBody = s.config.GetBool("session.token_in_body")
+		s.cookieSecure = s.config.GetBool("session.cookie_secure")
 		return nil
 	case "kratos":
 		kratosURL := s.config.GetString("session.url")
@@ -250,6 +389,20 @@ func (s *Server) setSessManager() error {
 	}
 }
 
+// setSessCache wraps session manager with the lookups cache if it is enabled
+func (s *Server) setSessCache() {
+	if !s.config.GetBool("session.cache.enabled") {
+		return
+	}
+	size := s.config.GetInt("session.cache.size")
+	ttl := s.config.GetDuration("session.cache.ttl")
+	negTTL := s.config.GetDuration("session.cache.negative_ttl")
+	sc := sesscache.New(s.sess, size, ttl, negTTL, sessCacheLookups)
+	s.sess = sc
+	s.sessCache = sc
+	s.log.Infof("session cache enabled, size=%d, ttl=%s, negative_ttl=%s", size, ttl, negTTL)
+}
+
 func (s *Server) setPermManager() error {
 	sessKind := s.config.GetString("permissions.source")
 	if sessKind == "" || sessKind != "keto" {
@@ -264,12 +417,56 @@ func (s *Server) setPermManager() error {
 			return err
 		}
 		s.perm = km
-		return nil
+		s.permTimeout = ketoTIO
+		if s.permTimeout <= 0 {
+			s.permTimeout = defaultPermTIO
+		}
+		if err := s.setPermFilters(); err != nil {
+			return err
+		}
+		if err := s.setAuthzRules(); err != nil {
+			return err
+		}
+		if err := s.setUsersAdmin(); err != nil {
+			return err
+		}
+		return s.setPermCache()
 	default:
 		return errors.New("doesn't defined kind of the permission manager")
 	}
 }
 
+// setPermCache sets on_error policy and makes permissions cache if it isn't disabled,
+// stale policy requires cache for keeping last known permissions
+func (s *Server) setPermCache() error {
+	s.permOnError = s.config.GetString("permissions.on_error")
+	switch s.permOnError {
+	case "":
+		s.permOnError = permOnErrorEmpty
+	case permOnErrorDeny, permOnErrorEmpty, permOnErrorStale:
+	default:
+		return fmt.Errorf("unknown permissions.on_error policy %q", s.permOnError)
+	}
+	enabled := s.config.GetBool("permissions.cache.enabled")
+	if !enabled && s.permOnError != permOnErrorStale {
+		s.log.Infof("permissions cache disabled, on_error=%s", s.permOnError)
+		return nil
+	}
+	var ttl time.Duration
+	if enabled {
+		ttl = s.config.GetDuration("permissions.cache.ttl")
+	}
+	var maxAge time.Duration
+	if s.permOnError == permOnErrorStale {
+		maxAge = s.config.GetDuration("permissions.stale_max_age")
+	}
+	size := s.config.GetInt("permissions.cache.size")
+	s.permCache = permcache.New(ttl, maxAge, size)
+	s.log.Infof("permissions cache enabled=%t, ttl=%s, size=%d, on_error=%s, stale_max_age=%s",
+		enabled, ttl, size, s.permOnError, maxAge)
+	return nil
+}
+
 func (s *Server) healthChecker(period time.Duration, cancel <-chan struct{}) {
 	s.log.Debugf("starting healthChecker")
 	defer s.log.Debugf("stopped healthChecker")
@@ -281,7 +478,7 @@ func (s *Server) healthChecker(period time.Duration, cancel <-chan struct{}) {
 			return
 		case <-tick.C:
 			s.log.Debug("time to healthCheck")
-			err := s.healthCheck()
+			err := s.healthCheck(context.Background())
 			if err != nil {
 				s.log.Errorf("healthCheck failed %s", err)
 			}
@@ -289,13 +486,12 @@ func (s *Server) healthChecker(period time.Duration, cancel <-chan struct{}) {
 	}
 }
 
-func (s *Server) healthCheck() error {
+func (s *Server) healthCheck(ctx context.Context) error {
 	// service_up general =1 if one of layoutRepo health OK
 	s.log.Debugf("starting healthCheck")
 	defer s.log.Debugf("stopped healthCheck")
 	dest := s.repo.GetSrvPortDB()
-	upDest := s.config.GetString("proxy.upstream")
-	err := s.repo.HealthCheck()
+	err := s.repo.HealthCheck(ctx)
 	if err != nil {
 		s.log.Errorf("HealthCheck error, %v", err)
 		s.mService.WithLabelValues(scope, dest, s.version, s.githash, s.build).Set(0)
@@ -303,20 +499,17 @@ func (s *Server) healthCheck() error {
 		return err
 	}
 	s.mService.WithLabelValues(scope, dest, s.version, s.githash, s.build).Set(1)
-	err = s.upstreamHealthCheck()
+	err = s.upstreamsHealthy()
 	if err != nil {
-		s.log.Errorf("upstreamHealthCheck error, %v", err)
-		s.mService.WithLabelValues(scopeUPStream, upDest, s.version, s.githash, s.build).Set(0)
+		s.log.Errorf("upstreamsHealthy error, %v", err)
 		s.mService.WithLabelValues("general", "localhost", s.version, s.githash, s.build).Set(0)
 		return err
 	}
-	s.mService.WithLabelValues(scopeUPStream, upDest, s.version, s.githash, s.build).Set(1)
 	s.mService.WithLabelValues("general", "localhost", s.version, s.githash, s.build).Set(1)
 	return nil
 }
 
-func (s *Server) upstreamHealthCheck() error {
-	upDest := s.config.GetString("proxy.health")
+func (s *Server) upstreamHealthCheck(upDest string) error {
 	uri := fmt.Sprintf("%s/health", upDest)
 	request, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
@@ -0,0 +1,95 @@
+package infra
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.countmax.ru/countmax/wda.back/internal/certs"
+	"github.com/labstack/echo/v4"
+)
+
+const defaultCertsReloadPeriod time.Duration = time.Minute
+
+// upstreamTransport makes transport of the upstream client with tls from proxy.tls,
+// certificate verification is disabled only by explicit proxy.tls.insecure
+func (s *Server) upstreamTransport() (*http.Transport, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if s.config.GetBool("proxy.tls.insecure") {
+		s.log.Warn("upstream tls certificate verification is disabled by proxy.tls.insecure")
+		// nolint:gosec
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		return tr, nil
+	}
+	ca := s.config.GetString("proxy.tls.ca")
+	cert := s.config.GetString("proxy.tls.cert")
+	key := s.config.GetString("proxy.tls.key")
+	files, err := certs.Load(cert, key, ca)
+	if err != nil {
+		return nil, fmt.Errorf("load proxy.tls certificates error, %w", err)
+	}
+	if ca != "" || cert != "" {
+		s.upstreamCerts = files
+	}
+	serverName := s.config.GetString("proxy.tls.server_name")
+	s.log.Infof("upstream tls, ca=%s, cert=%s, server_name=%s", ca, cert, serverName)
+	tr.TLSClientConfig = files.ClientConfig(serverName)
+	if ca != "" {
+		// upstreams from consul are addressed by ip, so they are verified against the dialed host
+		tr.DialTLSContext = files.DialTLSContext(serverName)
+	}
+	return tr, nil
+}
+
+// setServerTLS loads certificates of the main listener from httpd.tls and of the service listener
+// if httpd.service.tls is set, listeners serve plain http if httpd.tls.cert isn't specified
+func (s *Server) setServerTLS() error {
+	cert := s.config.GetString("httpd.tls.cert")
+	key := s.config.GetString("httpd.tls.key")
+	if cert == "" && key == "" {
+		return nil
+	}
+	clientCA := s.config.GetString("httpd.tls.client_ca")
+	files, err := certs.Load(cert, key, clientCA)
+	if err != nil {
+		return fmt.Errorf("load httpd.tls certificates error, %w", err)
+	}
+	s.httpdCerts = files
+	s.log.Infof("https enabled, cert=%s, client_ca=%s", cert, clientCA)
+	if !s.config.GetBool("httpd.service.tls") {
+		return nil
+	}
+	// metrics and health are requested by prometheus and consul without client certificates
+	files, err = certs.Load(cert, key, "")
+	if err != nil {
+		return fmt.Errorf("load httpd.tls certificates of the service listener error, %w", err)
+	}
+	s.serviceCerts = files
+	return nil
+}
+
+// startServer starts listener of e on the host, https if files are specified
+func startServer(e *echo.Echo, host string, files *certs.Files) error {
+	if files == nil {
+		return e.Start(host)
+	}
+	e.TLSServer.Addr = host
+	e.TLSServer.TLSConfig = files.ServerConfig()
+	return e.StartServer(e.TLSServer)
+}
+
+// certsReloader checks certificate files every period and reloads them when they change until ctx is done
+func (s *Server) certsReloader(ctx context.Context, name string, files *certs.Files, period time.Duration) {
+	if period <= 0 {
+		period = defaultCertsReloadPeriod
+	}
+	files.Run(ctx, period, func(err error) {
+		if err != nil {
+			s.log.Errorf("reload %s certificates error, previous are used, %v", name, err)
+			return
+		}
+		s.log.Infof("%s certificates reloaded", name)
+	})
+}
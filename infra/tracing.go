@@ -0,0 +1,168 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	traceIDName         string        = "trace_id"
+	tracerName          string        = "wda.back"
+	otlpTracesPath      string        = "/v1/traces"
+	defaultTraceTimeout time.Duration = 10 * time.Second
+	defaultTracePeriod  time.Duration = 5 * time.Second
+	defaultTraceBatch   int           = 512
+)
+
+var (
+	// traceProp propagates span context by the W3C traceparent header
+	traceProp = propagation.TraceContext{}
+	// noopTracer is used when tracing is disabled
+	noopTracer = trace.NewNoopTracerProvider().Tracer(tracerName)
+)
+
+// setTracer makes tracer exporting spans to the OTLP collector if tracing is enabled
+func (s *Server) setTracer() error {
+	if !s.config.GetBool("tracing.enabled") {
+		return nil
+	}
+	endpoint := s.config.GetString("tracing.endpoint")
+	if endpoint == "" {
+		return errors.New("tracing.endpoint must be specified")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid tracing.endpoint %q", endpoint)
+	}
+	timeout := s.config.GetDuration("tracing.timeout")
+	if timeout <= 0 {
+		timeout = defaultTraceTimeout
+	}
+	period := s.config.GetDuration("tracing.flush_period")
+	if period <= 0 {
+		period = defaultTracePeriod
+	}
+	batch := s.config.GetInt("tracing.batch_size")
+	if batch <= 0 {
+		batch = defaultTraceBatch
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(strings.TrimSuffix(u.Path, "/") + otlpTracesPath),
+		otlptracehttp.WithTimeout(timeout),
+	}
+	if u.Scheme != "https" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exp, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return fmt.Errorf("make OTLP exporter error, %w", err)
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		s.log.Warnf("export spans to %s failed, %v", endpoint, err)
+	}))
+	service := s.config.GetString("app.name")
+	ratio := s.config.GetFloat64("tracing.sample_ratio")
+	// traces started by the caller keep its sampling decision
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp,
+			sdktrace.WithMaxExportBatchSize(batch),
+			sdktrace.WithBatchTimeout(period),
+			sdktrace.WithExportTimeout(timeout)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+	)
+	s.traceProvider = tp
+	s.tracer = tp.Tracer(tracerName)
+	s.log.Infof("tracing enabled, endpoint=%s, service=%s, sample_ratio=%g", endpoint, service, ratio)
+	return nil
+}
+
+// stopTracer exports the rest of the spans and stops the exporter, must be called after the mux shutdown
+func (s *Server) stopTracer(ctx context.Context) {
+	if s.traceProvider == nil {
+		return
+	}
+	if err := s.traceProvider.Shutdown(ctx); err != nil {
+		s.log.Warnf("stop tracing error, %v", err)
+	}
+}
+
+// startSpan starts span as child of the span or remote span context in ctx, returns ctx with the new span
+func (s *Server) startSpan(ctx context.Context, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	tracer := s.tracer
+	if tracer == nil {
+		tracer = noopTracer
+	}
+	return tracer.Start(ctx, name, trace.WithSpanKind(kind))
+}
+
+// endSpan ends the span, not nil err marks span as failed
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceID returns hex trace id of the span in ctx, empty if there is no span
+func traceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// traceProxy - middleware starts client span of the proxied request and propagates it to the upstream by traceparent
+func (s *Server) traceProxy(r *proxyRoute) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if s.tracer == nil {
+				return next(c)
+			}
+			ctx, span := s.startSpan(c.Request().Context(), "proxy "+r.cfg.Name, trace.SpanKindClient)
+			req := c.Request().WithContext(ctx)
+			traceProp.Inject(ctx, propagation.HeaderCarrier(req.Header))
+			c.SetRequest(req)
+			err := next(c)
+			if t, ok := c.Get(middleware.DefaultProxyConfig.ContextKey).(*middleware.ProxyTarget); ok && t != nil {
+				span.SetAttributes(attribute.String("upstream.target", t.Name))
+			}
+			if err == nil {
+				code := c.Response().Status
+				span.SetAttributes(attribute.Int("http.status_code", code))
+				if code >= http.StatusInternalServerError {
+					span.SetStatus(codes.Error, http.StatusText(code))
+				}
+			}
+			endSpan(span, err)
+			return err
+		}
+	}
+}
+
+// repoSpan starts span of the users repository call, returns request context with the span for the call,
+// span must be ended with the call error
+func (s *Server) repoSpan(c echo.Context, op string) (context.Context, trace.Span) {
+	ctx, span := s.startSpan(c.Request().Context(), "repo."+op, trace.SpanKindClient)
+	span.SetAttributes(attribute.String("db.operation", op))
+	return ctx, span
+}
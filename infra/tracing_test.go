@@ -0,0 +1,47 @@
+package infra
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+)
+
+func TestServer_customHTTPLogger_trace(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	s := &Server{log: zap.NewNop().Sugar(), mAPI: httpDuration, tracer: tp.Tracer(tracerName)}
+	e := echo.New()
+	e.Use(s.customHTTPLogger)
+	var gotTraceID string
+	e.GET("/v1/users/:id", func(c echo.Context) error {
+		gotTraceID = traceID(c.Request().Context())
+		return c.NoContent(http.StatusOK)
+	})
+	const (
+		remoteTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+		remoteSpan  = "00f067aa0ba902b7"
+	)
+	req := httptest.NewRequest(http.MethodGet, "/v1/users/42", nil)
+	req.Header.Set("traceparent", "00-"+remoteTrace+"-"+remoteSpan+"-01")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := sr.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("ended spans = %d, want 1", len(spans))
+	}
+	sp := spans[0]
+	if sp.Name() != "GET /v1/users/:id" {
+		t.Errorf("span name = %q, want route pattern", sp.Name())
+	}
+	if got := sp.SpanContext().TraceID().String(); got != remoteTrace || gotTraceID != remoteTrace {
+		t.Errorf("trace id of span, request context = %s, %s, want %s", got, gotTraceID, remoteTrace)
+	}
+	if got := sp.Parent().SpanID().String(); got != remoteSpan {
+		t.Errorf("parent span id = %s, want %s", got, remoteSpan)
+	}
+}
@@ -0,0 +1,409 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.countmax.ru/countmax/wda.back/internal/upstream"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const consulSyncTimeout time.Duration = 10 * time.Second
+
+var errNoUpstreams = errors.New("there are no upstream targets")
+
+// UpstreamConfig proxied upstream target
+type UpstreamConfig struct {
+	URL    string `mapstructure:"url"`    // api url
+	Health string `mapstructure:"health"` // base url of the health check, url if empty
+}
+
+// ConsulConfig discovery of the upstream targets in consul
+type ConsulConfig struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	Service  string        `mapstructure:"service"`
+	Tag      string        `mapstructure:"tag"`
+	Scheme   string        `mapstructure:"scheme"`
+	APIPort  int           `mapstructure:"api_port"`
+	WaitTime time.Duration `mapstructure:"wait_time"`
+}
+
+// RouteConfig proxied route, requests with the path prefix are proxied to the route upstreams
+type RouteConfig struct {
+	Name      string           `mapstructure:"name"`      // name of the route, scope of the service_up metric
+	Prefix    string           `mapstructure:"prefix"`    // path prefix, e.g. /v2
+	Rewrite   string           `mapstructure:"rewrite"`   // replacement of the prefix for upstream, empty - path isn't changed
+	Timeout   time.Duration    `mapstructure:"timeout"`   // timeout of the upstream request, 0 - without timeout
+	Auth      *bool            `mapstructure:"auth"`      // check session and permissions, true if not defined
+	Upstreams []UpstreamConfig `mapstructure:"upstreams"` // static upstream targets
+	Consul    ConsulConfig     `mapstructure:"consul"`    // discovery of the upstream targets instead of static list
+}
+
+// proxyRoute route with its balancer
+type proxyRoute struct {
+	cfg      RouteConfig
+	balancer *upstream.Balancer
+	watcher  *upstream.Watcher
+}
+
+func (r *proxyRoute) auth() bool {
+	return r.cfg.Auth == nil || *r.cfg.Auth
+}
+
+// routeConfigs reads proxy.routes, if the table is empty makes single /v2 route
+// to layoutconfig.api from proxy.upstreams or proxy.upstream & proxy.health
+func (s *Server) routeConfigs() ([]RouteConfig, error) {
+	var cfgs []RouteConfig
+	if err := s.config.UnmarshalKey("proxy.routes", &cfgs); err != nil {
+		return nil, fmt.Errorf("read proxy.routes error, %w", err)
+	}
+	if len(cfgs) > 0 {
+		return cfgs, nil
+	}
+	def := RouteConfig{
+		Name:    scopeUPStream,
+		Prefix:  "/" + apiVersion,
+		Timeout: s.config.GetDuration("proxy.timeout_sec") * time.Second,
+	}
+	if err := s.config.UnmarshalKey("proxy.upstreams", &def.Upstreams); err != nil {
+		return nil, fmt.Errorf("read proxy.upstreams error, %w", err)
+	}
+	if err := s.config.UnmarshalKey("proxy.consul", &def.Consul); err != nil {
+		return nil, fmt.Errorf("read proxy.consul error, %w", err)
+	}
+	if len(def.Upstreams) == 0 {
+		def.Upstreams = append(def.Upstreams, UpstreamConfig{
+			URL:    s.config.GetString("proxy.upstream"),
+			Health: s.config.GetString("proxy.health"),
+		})
+	}
+	return []RouteConfig{def}, nil
+}
+
+// newProxyTarget makes balancer target, name of the target is its url
+func newProxyTarget(cfg UpstreamConfig) (*middleware.ProxyTarget, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url %s error, %w", cfg.URL, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("bad upstream url %s, scheme and host must be specified", cfg.URL)
+	}
+	health := cfg.Health
+	if health == "" {
+		health = cfg.URL
+	}
+	return &middleware.ProxyTarget{
+		Name: u.String(),
+		URL:  u,
+		Meta: echo.Map{upstream.MetaHealth: health},
+	}, nil
+}
+
+// newProxyRoutes makes routes with health-aware balancers from the config
+func (s *Server) newProxyRoutes() ([]*proxyRoute, error) {
+	cfgs, err := s.routeConfigs()
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make(map[string]bool, len(cfgs))
+	routes := make([]*proxyRoute, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		cfg.Prefix = "/" + strings.Trim(cfg.Prefix, "/")
+		if cfg.Prefix == "/" || cfg.Prefix == "/"+apiLocalVersion {
+			return nil, fmt.Errorf("route %s, prefix %s is reserved", cfg.Name, cfg.Prefix)
+		}
+		if prefixes[cfg.Prefix] {
+			return nil, fmt.Errorf("route %s, duplicated prefix %s", cfg.Name, cfg.Prefix)
+		}
+		prefixes[cfg.Prefix] = true
+		if cfg.Name == "" {
+			cfg.Name = cfg.Prefix
+		}
+		r := &proxyRoute{
+			cfg: cfg,
+			balancer: upstream.NewBalancer(
+				s.config.GetInt("proxy.unhealthy_threshold"),
+				s.config.GetInt("proxy.healthy_threshold")),
+		}
+		s.setBreaker(r)
+		if cfg.Consul.Enabled {
+			if err := s.setUpstreamWatcher(r); err != nil {
+				return nil, err
+			}
+			routes = append(routes, r)
+			continue
+		}
+		if len(cfg.Upstreams) == 0 {
+			return nil, fmt.Errorf("route %s, upstreams must be specified", cfg.Name)
+		}
+		for _, ucfg := range cfg.Upstreams {
+			pt, err := newProxyTarget(ucfg)
+			if err != nil {
+				return nil, fmt.Errorf("route %s, %w", cfg.Name, err)
+			}
+			if !r.balancer.AddTarget(pt) {
+				return nil, fmt.Errorf("route %s, duplicated upstream %s", cfg.Name, pt.Name)
+			}
+			s.mService.WithLabelValues(cfg.Name, pt.Name, s.version, s.githash, s.build).Set(1)
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// registerProxyRoutes adds proxy routes to the echo instance
+func (s *Server) registerProxyRoutes(e *echo.Echo) {
+	for _, r := range s.routes {
+		g := e.Group(r.cfg.Prefix)
+		g.Use(s.requireCanonicalPath)
+		g.Use(s.stripIdentityHeaders)
+		if r.auth() {
+			g.Use(s.rateLimitIP(r.cfg.Name))
+			g.Use(s.checkSession)
+			g.Use(s.authorize)
+		}
+		g.Use(s.rateLimit(r.cfg.Name))
+		g.Use(s.requireUpstream(r))
+		if r.cfg.Timeout > 0 {
+			g.Use(upstreamTimeout(r.cfg.Timeout))
+		}
+		g.Use(s.proxyErrors)
+		g.Use(s.traceProxy(r))
+		pc := middleware.DefaultProxyConfig
+		pc.Balancer = r.balancer
+		pc.Transport = s.newUpstreamTransport(r)
+		if r.cfg.Rewrite != "" {
+			pc.Rewrite = prefixRewrite(r.cfg.Prefix, r.cfg.Rewrite)
+		}
+		g.Use(middleware.ProxyWithConfig(pc))
+		s.log.Infof("proxy route %s, prefix=%s, rewrite=%s, timeout=%s, auth=%t, targets=%d",
+			r.cfg.Name, r.cfg.Prefix, r.cfg.Rewrite, r.cfg.Timeout, r.auth(), len(r.balancer.Targets()))
+	}
+}
+
+// prefixRewrite makes proxy rewrite rules replacing the prefix of the path by the rewrite,
+// rules are anchored and exclusive: bare prefix, prefix with query and prefix with subpath
+func prefixRewrite(prefix, rewrite string) map[string]string {
+	rewrite = strings.TrimSuffix(rewrite, "/")
+	bare := rewrite
+	if bare == "" {
+		bare = "/"
+	}
+	return map[string]string{
+		"^" + prefix:        bare,
+		"^" + prefix + "?*": bare + "?$1",
+		"^" + prefix + "/*": rewrite + "/$1",
+	}
+}
+
+// setBreaker enables circuit breaker of the route targets if proxy.breaker.threshold is set
+func (s *Server) setBreaker(r *proxyRoute) {
+	threshold := s.config.GetInt("proxy.breaker.threshold")
+	if threshold <= 0 {
+		return
+	}
+	cooldown := s.config.GetDuration("proxy.breaker.cooldown")
+	r.balancer.SetBreaker(threshold, cooldown, func(name string, st upstream.State) {
+		if st == upstream.StateClosed {
+			s.log.Infof("route %s, upstream %s circuit %s", r.cfg.Name, name, st)
+		} else {
+			s.log.Warnf("route %s, upstream %s circuit %s", r.cfg.Name, name, st)
+		}
+		upstreamCircuit.WithLabelValues(r.cfg.Name, name).Set(float64(st))
+	})
+}
+
+// newUpstreamTransport makes transport of the route with retries of the idempotent requests,
+// connections are made by the transport of the upstream client with its tls config
+func (s *Server) newUpstreamTransport(r *proxyRoute) http.RoundTripper {
+	return &upstream.Transport{
+		Balancer: r.balancer,
+		Base:     s.handler.Transport,
+		Retries:  s.config.GetInt("proxy.retries"),
+		Backoff:  s.config.GetDuration("proxy.retry_backoff"),
+		OnRetry: func(from, to string) {
+			s.log.Warnf("route %s, retry request from %s to %s", r.cfg.Name, from, to)
+			upstreamRetries.WithLabelValues(r.cfg.Name, from, to).Inc()
+		},
+	}
+}
+
+// proxyErrors - middleware renders proxy failures as ErrResponse instead of the echo default body
+func (s *Server) proxyErrors(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		if err == nil || c.Response().Committed {
+			return err
+		}
+		var he *echo.HTTPError
+		if !errors.As(err, &he) {
+			return err
+		}
+		cause := he.Internal
+		if cause == nil {
+			cause = err
+		}
+		switch {
+		case errors.Is(cause, upstream.ErrCircuitOpen):
+			return sendError(c, ErrServiceUnavailable(cause).WithCode(CodeCircuitOpen))
+		case errors.Is(c.Request().Context().Err(), context.DeadlineExceeded):
+			return sendError(c, ErrGatewayTimeout(cause))
+		case he.Code == middleware.StatusCodeContextCanceled:
+			resp := newErrResponse(he.Code, cause).WithCode(CodeClientClosed)
+			resp.StatusText = "Client Closed Request"
+			return sendError(c, resp)
+		default:
+			return sendError(c, ErrBadGateway(cause))
+		}
+	}
+}
+
+// setUpstreamWatcher makes watcher of the route upstream instances in consul
+// and fills balancer by instances available at the moment
+func (s *Server) setUpstreamWatcher(r *proxyRoute) error {
+	config := consulapi.DefaultConfig()
+	config.Address = s.config.GetString("consul.url")
+	client, err := consulapi.NewClient(config)
+	if err != nil {
+		return fmt.Errorf("set consul config for upstreams discovery error, %w", err)
+	}
+	w := upstream.NewWatcher(client, upstream.WatcherConfig{
+		Service:  r.cfg.Consul.Service,
+		Tag:      r.cfg.Consul.Tag,
+		Scheme:   r.cfg.Consul.Scheme,
+		APIPort:  r.cfg.Consul.APIPort,
+		WaitTime: r.cfg.Consul.WaitTime,
+	}, r.balancer, s.log)
+	w.OnUpdate = s.upstreamsUpdated(r)
+	ctx, cancel := context.WithTimeout(context.Background(), consulSyncTimeout)
+	defer cancel()
+	if _, err := w.Sync(ctx, 0); err != nil {
+		s.log.Errorf("route %s, initial discovery of the upstreams in consul error, %v", r.cfg.Name, err)
+	}
+	r.watcher = w
+	return nil
+}
+
+// upstreamsUpdated returns handler of the targets discovered or removed by the watcher,
+// metrics of the removed targets are deleted
+func (s *Server) upstreamsUpdated(r *proxyRoute) func(added, removed []string) {
+	return func(added, removed []string) {
+		for _, name := range added {
+			s.mService.WithLabelValues(r.cfg.Name, name, s.version, s.githash, s.build).Set(1)
+		}
+		for _, name := range removed {
+			s.mService.DeleteLabelValues(r.cfg.Name, name, s.version, s.githash, s.build)
+			upstreamCircuit.DeleteLabelValues(r.cfg.Name, name)
+		}
+	}
+}
+
+// requireUpstream - middleware responds 503 if there are no route targets to proxy
+func (s *Server) requireUpstream(r *proxyRoute) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if len(r.balancer.Targets()) == 0 {
+				return sendError(c, ErrServiceUnavailable(errNoUpstreams))
+			}
+			return next(c)
+		}
+	}
+}
+
+// upstreamTimeout - middleware limits duration of the proxied request
+func upstreamTimeout(timeout time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+// upstreamsChecker checks upstream targets with period
+func (s *Server) upstreamsChecker(period time.Duration, cancel <-chan struct{}) {
+	s.log.Debugf("starting upstreamsChecker")
+	defer s.log.Debugf("stopped upstreamsChecker")
+	tick := time.NewTicker(period)
+	for {
+		select {
+		case <-cancel:
+			tick.Stop()
+			return
+		case <-tick.C:
+			err := s.upstreamsHealthCheck()
+			if err != nil {
+				s.log.Errorf("upstreamsHealthCheck failed %s", err)
+			}
+		}
+	}
+}
+
+// upstreamsHealthy returns error if there is a route without healthy targets,
+// targets aren't probed, their state is maintained by upstreamsChecker
+func (s *Server) upstreamsHealthy() error {
+	var failed []string
+	for _, r := range s.routes {
+		healthy := false
+		for _, pt := range r.balancer.Targets() {
+			if r.balancer.Healthy(pt.Name) {
+				healthy = true
+				break
+			}
+		}
+		if !healthy {
+			failed = append(failed, r.cfg.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("there are no healthy upstream targets for routes %v", failed)
+	}
+	return nil
+}
+
+// upstreamsHealthCheck checks every upstream target of every route,
+// ejects failed and re-admits recovered targets,
+// returns error if there is a route without healthy targets
+func (s *Server) upstreamsHealthCheck() error {
+	var failed []string
+	for _, r := range s.routes {
+		healthyCount := 0
+		for _, pt := range r.balancer.Targets() {
+			health, _ := pt.Meta[upstream.MetaHealth].(string)
+			err := s.upstreamHealthCheck(health)
+			if err != nil {
+				s.log.Errorf("route %s, upstreamHealthCheck %s error, %v", r.cfg.Name, pt.Name, err)
+			}
+			healthy, changed := r.balancer.Report(pt.Name, err)
+			if changed && healthy {
+				s.log.Infof("route %s, upstream %s re-admitted", r.cfg.Name, pt.Name)
+			}
+			if changed && !healthy {
+				s.log.Warnf("route %s, upstream %s ejected", r.cfg.Name, pt.Name)
+			}
+			if healthy {
+				healthyCount++
+				s.mService.WithLabelValues(r.cfg.Name, pt.Name, s.version, s.githash, s.build).Set(1)
+				continue
+			}
+			s.mService.WithLabelValues(r.cfg.Name, pt.Name, s.version, s.githash, s.build).Set(0)
+		}
+		if healthyCount == 0 {
+			failed = append(failed, r.cfg.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("there are no healthy upstream targets for routes %v", failed)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package infra
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.countmax.ru/countmax/wda.back/internal/upstream"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+func TestServer_registerProxyRoutes(t *testing.T) {
+	paths := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.RequestURI()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	auth := false
+	config := viper.New()
+	config.Set("proxy.routes", []RouteConfig{
+		{Name: "layoutconfig.api", Prefix: "/v2", Timeout: time.Second, Upstreams: []UpstreamConfig{{URL: upstream.URL}}},
+		{Name: "reports.api", Prefix: "/reports/", Rewrite: "/api/v1", Auth: &auth, Upstreams: []UpstreamConfig{{URL: upstream.URL}}},
+	})
+	s := &Server{
+		log:      zap.NewNop().Sugar(),
+		config:   config,
+		sess:     fakeSessManager{},
+		handler:  &http.Client{Transport: http.DefaultTransport},
+		mService: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_service_up"}, []string{"scope", "destination", "version", "githash", "build"}),
+	}
+	routes, err := s.newProxyRoutes()
+	if err != nil {
+		t.Fatalf("Server.newProxyRoutes() error = %v", err)
+	}
+	s.routes = routes
+	e := echo.New()
+	s.registerProxyRoutes(e)
+
+	tests := []struct {
+		name     string
+		uri      string
+		wantCode int
+		wantPath string
+	}{
+		{"auth_required", "/v2/layouts", http.StatusUnauthorized, ""},
+		{"rewrite_public", "/reports/daily?from=2021-07-01", http.StatusOK, "/api/v1/daily?from=2021-07-01"},
+		{"rewrite_bare", "/reports", http.StatusOK, "/api/v1"},
+		{"rewrite_bare_query", "/reports?from=2021-07-01", http.StatusOK, "/api/v1?from=2021-07-01"},
+		{"rewrite_nested_prefix", "/reports/reports", http.StatusOK, "/api/v1/reports"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.uri, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("response code = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantPath == "" {
+				return
+			}
+			if got := <-paths; got != tt.wantPath {
+				t.Errorf("upstream uri = %s, want %s", got, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestServer_upstreamsHealthy(t *testing.T) {
+	probes := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	config := viper.New()
+	config.Set("proxy.routes", []RouteConfig{
+		{Name: "layoutconfig.api", Prefix: "/v2", Upstreams: []UpstreamConfig{{URL: upstream.URL}}},
+	})
+	s := &Server{
+		log:      zap.NewNop().Sugar(),
+		config:   config,
+		handler:  &http.Client{Transport: http.DefaultTransport},
+		mService: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_healthy_service_up"}, []string{"scope", "destination", "version", "githash", "build"}),
+	}
+	routes, err := s.newProxyRoutes()
+	if err != nil {
+		t.Fatalf("Server.newProxyRoutes() error = %v", err)
+	}
+	s.routes = routes
+	if err := s.upstreamsHealthy(); err != nil {
+		t.Errorf("Server.upstreamsHealthy() error = %v", err)
+	}
+	pt := routes[0].balancer.Targets()[0]
+	for i := 0; i < 3; i++ {
+		routes[0].balancer.Report(pt.Name, errors.New("down"))
+	}
+	if err := s.upstreamsHealthy(); err == nil {
+		t.Errorf("Server.upstreamsHealthy() of ejected target must fail")
+	}
+	if probes != 0 {
+		t.Errorf("Server.upstreamsHealthy() probed upstream %d times, want 0", probes)
+	}
+}
+
+func TestServer_upstreamsUpdated(t *testing.T) {
+	s := &Server{
+		log:      zap.NewNop().Sugar(),
+		mService: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_updated_service_up"}, []string{"scope", "destination", "version", "githash", "build"}),
+	}
+	r := &proxyRoute{cfg: RouteConfig{Name: "layoutconfig.api"}}
+	const target = "http://10.0.0.1:8080"
+	updated := s.upstreamsUpdated(r)
+	updated([]string{target}, nil)
+	upstreamCircuit.WithLabelValues(r.cfg.Name, target).Set(float64(upstream.StateOpen))
+	updated(nil, []string{target})
+	if upstreamCircuit.DeleteLabelValues(r.cfg.Name, target) {
+		t.Errorf("circuit state of the removed target must be deleted")
+	}
+	if s.mService.DeleteLabelValues(r.cfg.Name, target, s.version, s.githash, s.build) {
+		t.Errorf("service_up of the removed target must be deleted")
+	}
+}
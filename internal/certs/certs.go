@@ -0,0 +1,217 @@
+// Package certs contains tls certificates loaded from files and reloaded when the files change
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNoCerts there are no certificates in the CA file
+var ErrNoCerts = errors.New("there are no certificates in the CA file")
+
+// Files certificate with key and CA bundle, any of them can be omitted
+type Files struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	mods     map[string]time.Time
+}
+
+// Load makes new instance of the Files and loads them,
+// certFile and keyFile must be specified together
+func Load(certFile, keyFile, caFile string) (*Files, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("cert and key files must be specified together")
+	}
+	f := &Files{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		mods:     make(map[string]time.Time),
+	}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload loads files again if any of them is modified, previous certificates are kept on error
+func (f *Files) Reload() (bool, error) {
+	mods := make(map[string]time.Time, 3)
+	changed := false
+	for _, name := range []string{f.certFile, f.keyFile, f.caFile} {
+		if name == "" {
+			continue
+		}
+		st, err := os.Stat(name)
+		if err != nil {
+			return false, err
+		}
+		mods[name] = st.ModTime()
+		f.mu.RLock()
+		prev, ok := f.mods[name]
+		f.mu.RUnlock()
+		if !ok || !prev.Equal(st.ModTime()) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	var (
+		cert *tls.Certificate
+		pool *x509.CertPool
+	)
+	if f.certFile != "" {
+		c, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return false, fmt.Errorf("load key pair %s error, %w", f.certFile, err)
+		}
+		cert = &c
+	}
+	if f.caFile != "" {
+		bts, err := ioutil.ReadFile(f.caFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bts) {
+			return false, fmt.Errorf("%s, %w", f.caFile, ErrNoCerts)
+		}
+	}
+	f.mu.Lock()
+	f.cert = cert
+	f.pool = pool
+	f.mods = mods
+	f.mu.Unlock()
+	return true, nil
+}
+
+// Run checks files every period and reloads them if changed, onReload is called on reload or its error
+func (f *Files) Run(ctx context.Context, period time.Duration, onReload func(error)) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := f.Reload()
+			if (changed || err != nil) && onReload != nil {
+				onReload(err)
+			}
+		}
+	}
+}
+
+// Certificate returns current certificate, nil if it isn't specified
+func (f *Files) Certificate() *tls.Certificate {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.cert
+}
+
+// Pool returns current CA pool, nil if it isn't specified
+func (f *Files) Pool() *x509.CertPool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.pool
+}
+
+// ClientConfig makes tls config of the client with the current certificate as client certificate
+// and the current CA pool as roots, system roots are used if there is no CA file;
+// with CA file the server is verified against serverName or SNI name, so for upstreams addressed by ip
+// use DialTLSContext, which verifies against the dialed host
+func (f *Files) ClientConfig(serverName string) *tls.Config {
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if f.certFile != "" {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return f.Certificate(), nil
+		}
+	}
+	if f.caFile != "" {
+		// roots can be reloaded, so the chain is verified by VerifyConnection against the current pool
+		cfg.InsecureSkipVerify = true // nolint:gosec
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return f.verifyServer(cs, serverName)
+		}
+	}
+	return cfg
+}
+
+// DialTLSContext makes dial func of the http.Transport, which verifies server against serverName
+// or the dialed host if serverName is empty, ip addresses are checked against ip SANs
+func (f *Files) DialTLSContext(serverName string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		name := serverName
+		if name == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			name = host
+		}
+		td := &tls.Dialer{NetDialer: dialer, Config: f.ClientConfig(name)}
+		return td.DialContext(ctx, network, addr)
+	}
+}
+
+// ServerConfig makes tls config of the server with the current certificate,
+// if there is CA file client certificates are required and verified against the current CA pool
+func (f *Files) ServerConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return f.Certificate(), nil
+		},
+	}
+	if f.caFile != "" {
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := cfg.Clone()
+			c.GetConfigForClient = nil
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+			c.ClientCAs = f.Pool()
+			return c, nil
+		}
+	}
+	return cfg
+}
+
+// verifyServer verifies server chain and name against the current CA pool,
+// name is SNI name if it isn't specified, empty name isn't accepted
+func (f *Files) verifyServer(cs tls.ConnectionState, name string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server didn't present certificate")
+	}
+	if name == "" {
+		name = cs.ServerName
+	}
+	if name == "" {
+		return errors.New("server name to verify is unknown")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         f.Pool(),
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
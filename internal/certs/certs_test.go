@@ -0,0 +1,299 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns PEM certificate and key signed by the CA, dns can be ip address
+func (ca *testCA) issue(t *testing.T, serial int64, dns string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: dns},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(dns); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{dns}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+}
+
+func writeFile(t *testing.T, name string, data []byte, mod time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFiles_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, "test ca")
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	now := time.Now()
+	crt, key := ca.issue(t, 2, "localhost")
+	writeFile(t, certFile, crt, now)
+	writeFile(t, keyFile, key, now)
+
+	f, err := Load(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	first := f.Certificate()
+	if changed, err := f.Reload(); changed || err != nil {
+		t.Fatalf("Reload() of not modified files = %t, %v, want false, nil", changed, err)
+	}
+	crt, key = ca.issue(t, 3, "localhost")
+	writeFile(t, certFile, crt, now.Add(time.Minute))
+	writeFile(t, keyFile, key, now.Add(time.Minute))
+	if changed, err := f.Reload(); !changed || err != nil {
+		t.Fatalf("Reload() of modified files = %t, %v, want true, nil", changed, err)
+	}
+	if f.Certificate() == first {
+		t.Errorf("Reload() didn't replace certificate")
+	}
+	writeFile(t, keyFile, []byte("broken"), now.Add(2*time.Minute))
+	if _, err := f.Reload(); err == nil {
+		t.Errorf("Reload() of broken key must fail")
+	}
+	if f.Certificate() == nil {
+		t.Errorf("Reload() error must keep previous certificate")
+	}
+}
+
+func TestFiles_ClientConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, "test ca")
+	other := newTestCA(t, "other ca")
+	crt, key := ca.issue(t, 2, "upstream.local")
+	srvCert, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{srvCert}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		ca         []byte
+		serverName string
+		wantErr    bool
+	}{
+		{name: "trusted ca", ca: ca.pem, serverName: "upstream.local"},
+		{name: "unknown ca", ca: other.pem, serverName: "upstream.local", wantErr: true},
+		{name: "wrong server name", ca: ca.pem, serverName: "evil.local", wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caFile := filepath.Join(dir, "ca.crt")
+			writeFile(t, caFile, tt.ca, time.Now().Add(time.Duration(i)*time.Minute))
+			f, err := Load("", "", caFile)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: f.ClientConfig(tt.serverName)}}
+			resp, err := client.Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("client.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFiles_DialTLSContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, "test ca")
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem, time.Now())
+	f, err := Load("", "", caFile)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	tests := []struct {
+		name       string
+		san        string
+		serverName string
+		wantErr    bool
+	}{
+		{name: "ip san", san: "127.0.0.1"},
+		{name: "wrong san of ip upstream", san: "upstream.local", wantErr: true},
+		{name: "wrong ip san", san: "10.0.0.1", wantErr: true},
+		{name: "server name", san: "upstream.local", serverName: "upstream.local"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crt, key := ca.issue(t, int64(i+2), tt.san)
+			srvCert, err := tls.X509KeyPair(crt, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			srv.TLS = &tls.Config{Certificates: []tls.Certificate{srvCert}}
+			srv.StartTLS()
+			defer srv.Close()
+			client := &http.Client{Transport: &http.Transport{DialTLSContext: f.DialTLSContext(tt.serverName)}}
+			resp, err := client.Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("client.Get(%s) error = %v, wantErr %v", srv.URL, err, tt.wantErr)
+			}
+		})
+	}
+	// plain ClientConfig doesn't know the ip of the upstream and must fail closed
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: f.ClientConfig("")}}
+	crt, key := ca.issue(t, 10, "upstream.local")
+	srvCert, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{srvCert}}
+	srv.StartTLS()
+	defer srv.Close()
+	if resp, err := client.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("ClientConfig(\"\") accepted certificate of other host for ip upstream")
+	}
+}
+
+func TestFiles_ServerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, "test ca")
+	now := time.Now()
+	files := map[string][]byte{"ca.crt": ca.pem}
+	files["srv.crt"], files["srv.key"] = ca.issue(t, 2, "wda.local")
+	files["cli.crt"], files["cli.key"] = ca.issue(t, 3, "client")
+	for name, data := range files {
+		writeFile(t, filepath.Join(dir, name), data, now)
+	}
+	srvFiles, err := Load(filepath.Join(dir, "srv.crt"), filepath.Join(dir, "srv.key"), filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = srvFiles.ServerConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		cert    string
+		wantErr bool
+	}{
+		{name: "with client certificate", cert: "cli"},
+		{name: "without client certificate", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certFile, keyFile := "", ""
+			if tt.cert != "" {
+				certFile, keyFile = filepath.Join(dir, tt.cert+".crt"), filepath.Join(dir, tt.cert+".key")
+			}
+			f, err := Load(certFile, keyFile, filepath.Join(dir, "ca.crt"))
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: f.ClientConfig("wda.local")}}
+			resp, err := client.Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("client.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
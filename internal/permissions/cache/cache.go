@@ -0,0 +1,151 @@
+// Package cache contains per-subject TTL cache of the permission lookups
+// with coalescing of the concurrent lookups for the same key
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LoadFunc loads value for the key from the permissions manager
+type LoadFunc func() (string, error)
+
+type entry struct {
+	key    string
+	value  string
+	loaded time.Time
+}
+
+type call struct {
+	wg    sync.WaitGroup
+	value string
+	err   error
+}
+
+// Cache keeps loaded permissions ttl, concurrent loads of the same key are made once;
+// expired values are kept up to maxAge for the Stale,
+// count of the kept values is bounded by size, least recently used are evicted first
+type Cache struct {
+	ttl    time.Duration
+	maxAge time.Duration
+	size   int
+	mu     sync.Mutex
+	lru    *list.List
+	items  map[string]*list.Element
+	calls  map[string]*call
+	now    func() time.Time
+}
+
+// New makes new instance of the Cache, ttl - lifetime of the loaded value,
+// maxAge - lifetime of the value available for Stale (ttl if less than ttl),
+// size - max count of the kept keys (0 - unbounded)
+func New(ttl, maxAge time.Duration, size int) *Cache {
+	if maxAge < ttl {
+		maxAge = ttl
+	}
+	return &Cache{
+		ttl:    ttl,
+		maxAge: maxAge,
+		size:   size,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element),
+		calls:  make(map[string]*call),
+		now:    time.Now,
+	}
+}
+
+// Get returns fresh value for the key or loads it,
+// callers which ask for the same key during loading wait for the same result
+func (c *Cache) Get(key string, load LoadFunc) (string, error) {
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		if e := el.Value.(*entry); c.now().Sub(e.loaded) < c.ttl {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return e.value, nil
+		}
+	}
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		cl.wg.Wait()
+		return cl.value, cl.err
+	}
+	cl := &call{}
+	cl.wg.Add(1)
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	cl.value, cl.err = load()
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if cl.err == nil {
+		c.set(key, cl.value)
+	}
+	c.mu.Unlock()
+	cl.wg.Done()
+	return cl.value, cl.err
+}
+
+// Stale returns last loaded value for the key if it was loaded not earlier than maxAge ago,
+// used when the permissions manager is unavailable
+func (c *Cache) Stale(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+	e := el.Value.(*entry)
+	if c.now().Sub(e.loaded) > c.maxAge {
+		c.remove(el)
+		return "", false
+	}
+	return e.value, true
+}
+
+// Evict removes value of the key from the cache
+func (c *Cache) Evict(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+// SetClock sets source of the current time, time.Now by default
+func (c *Cache) SetClock(now func() time.Time) {
+	c.mu.Lock()
+	c.now = now
+	c.mu.Unlock()
+}
+
+// Len returns count of the kept values
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// set stores value and evicts least recently used values over size, must be called under lock
+func (c *Cache) set(key, value string) {
+	now := c.now()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry)
+		e.value = value
+		e.loaded = now
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.lru.PushFront(&entry{key: key, value: value, loaded: now})
+	for c.size > 0 && c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove deletes element, must be called under lock
+func (c *Cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.items, el.Value.(*entry).key)
+}
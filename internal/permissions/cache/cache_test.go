@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache_GetCoalesce(t *testing.T) {
+	c := New(time.Hour, 0, 0)
+	var calls int32
+	release := make(chan struct{})
+	load := func() (string, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "perms", nil
+	}
+	const n = 10
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			got, err := c.Get("subject", load)
+			if err != nil || got != "perms" {
+				t.Errorf("Cache.Get() = %q, %v, want perms, nil", got, err)
+			}
+		}()
+	}
+	// let all goroutines to join the first load
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("concurrent Cache.Get() must load once, loads = %d", calls)
+	}
+	// cached value
+	_, _ = c.Get("subject", load)
+	if calls != 1 {
+		t.Errorf("Cache.Get() of the fresh value must not load, loads = %d", calls)
+	}
+}
+
+func TestCache_GetExpiredAndErrors(t *testing.T) {
+	c := New(0, 0, 0)
+	calls := 0
+	load := func() (string, error) {
+		calls++
+		return "v", nil
+	}
+	_, _ = c.Get("k", load)
+	_, _ = c.Get("k", load)
+	if calls != 2 {
+		t.Errorf("expired value must be reloaded, loads = %d", calls)
+	}
+	errLoad := errors.New("keto unavailable")
+	c = New(time.Hour, 0, 0)
+	_, err := c.Get("k", func() (string, error) { return "", errLoad })
+	if !errors.Is(err, errLoad) {
+		t.Errorf("Cache.Get() error = %v, want %v", err, errLoad)
+	}
+	got, err := c.Get("k", load)
+	if err != nil || got != "v" {
+		t.Errorf("errors must not be cached, Cache.Get() = %q, %v", got, err)
+	}
+}
+
+func TestCache_Stale(t *testing.T) {
+	load := func() (string, error) { return "v", nil }
+	c := New(0, time.Hour, 0)
+	_, _ = c.Get("k", load)
+	if got, ok := c.Stale("k"); !ok || got != "v" {
+		t.Errorf("Cache.Stale() = %q, %v, want v, true", got, ok)
+	}
+	if _, ok := c.Stale("unknown"); ok {
+		t.Errorf("Cache.Stale() of unknown key must be missed")
+	}
+	c = New(0, 0, 0)
+	_, _ = c.Get("k", load)
+	time.Sleep(time.Millisecond)
+	if _, ok := c.Stale("k"); ok {
+		t.Errorf("Cache.Stale() older than maxAge must be missed")
+	}
+}
+
+func TestCache_SizeLRU(t *testing.T) {
+	c := New(time.Hour, 0, 2)
+	load := func(v string) LoadFunc {
+		return func() (string, error) { return v, nil }
+	}
+	_, _ = c.Get("a", load("a"))
+	_, _ = c.Get("b", load("b"))
+	// a becomes recently used, b must be evicted
+	_, _ = c.Get("a", load("a"))
+	_, _ = c.Get("c", load("c"))
+	if got := c.Len(); got != 2 {
+		t.Errorf("Cache.Len() = %d, want 2", got)
+	}
+	if _, ok := c.Stale("b"); ok {
+		t.Errorf("least recently used key must be evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if got, ok := c.Stale(k); !ok || got != k {
+			t.Errorf("Cache.Stale(%s) = %q, %v, want %s, true", k, got, ok, k)
+		}
+	}
+}
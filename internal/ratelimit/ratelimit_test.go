@@ -0,0 +1,44 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	now := time.Now()
+	l := New(2, 2)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("uid-1"); !ok {
+			t.Fatalf("Limiter.Allow() #%d = false, burst must be allowed", i)
+		}
+	}
+	ok, wait := l.Allow("uid-1")
+	if ok {
+		t.Fatalf("Limiter.Allow() over burst = true, want false")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Limiter.Allow() retry after = %s, want 500ms", wait)
+	}
+	if ok, _ := l.Allow("uid-2"); !ok {
+		t.Errorf("Limiter.Allow() other key must have own bucket")
+	}
+	now = now.Add(wait)
+	if ok, _ := l.Allow("uid-1"); !ok {
+		t.Errorf("Limiter.Allow() after refill = false, want true")
+	}
+}
+
+func TestLimiter_Sweep(t *testing.T) {
+	now := time.Now()
+	l := New(1, 1)
+	l.now = func() time.Time { return now }
+	_, _ = l.Allow("a")
+	now = now.Add(2 * sweepPeriod)
+	_, _ = l.Allow("b")
+	if _, ok := l.buckets["a"]; ok {
+		t.Errorf("refilled bucket must be swept")
+	}
+}
@@ -0,0 +1,30 @@
+package reqid
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want bool
+	}{
+		{"generated", New(), true},
+		{"uuid", "0f8fad5b-d9cb-469f-a165-70867728950e", true},
+		{"empty", "", false},
+		{"too_long", strings.Repeat("a", MaxLen+1), false},
+		{"max_len", strings.Repeat("a", MaxLen), true},
+		{"newline", "id\nforged log line", false},
+		{"space", "id 1", false},
+		{"non_ascii", "ид", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Valid(tt.id); got != tt.want {
+				t.Errorf("Valid(%q) = %v, want %v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Package cache contains bounded TTL/LRU cache of the session lookups
+// in front of any session manager
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"git.countmax.ru/countmax/wda.back/internal/session"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	resultHit  string = "hit"
+	resultMiss string = "miss"
+)
+
+type entry struct {
+	key     session.ID
+	sess    *session.Session
+	expires time.Time
+}
+
+// Manager caches results of the wrapped manager Check,
+// found sessions live ttl, not found sessions live negTTL
+type Manager struct {
+	session.ManagerInterface
+	size    int
+	ttl     time.Duration
+	negTTL  time.Duration
+	mu      sync.Mutex
+	lru     *list.List
+	items   map[session.ID]*list.Element
+	mLookup *prometheus.CounterVec
+}
+
+// New makes new instance of the Manager;
+// next - wrapped manager, size - max count of cached sessions,
+// ttl - lifetime of found session, negTTL - lifetime of not found session (0 - don't cache),
+// mLookup - counter of lookups with label result=hit|miss, may be nil
+func New(next session.ManagerInterface, size int, ttl, negTTL time.Duration,
+	mLookup *prometheus.CounterVec) *Manager {
+	return &Manager{
+		ManagerInterface: next,
+		size:             size,
+		ttl:              ttl,
+		negTTL:           negTTL,
+		lru:              list.New(),
+		items:            make(map[session.ID]*list.Element),
+		mLookup:          mLookup,
+	}
+}
+
+// Check returns session from the cache or from the wrapped manager,
+// result of the wrapped manager isn't cached if ctx is done, so canceled lookup isn't cached as not found
+func (m *Manager) Check(ctx context.Context, id *session.ID) *session.Session {
+	if id == nil {
+		return m.ManagerInterface.Check(ctx, id)
+	}
+	if sess, ok := m.get(*id); ok {
+		m.observe(resultHit)
+		return sess
+	}
+	m.observe(resultMiss)
+	sess := m.ManagerInterface.Check(ctx, id)
+	if ctx.Err() != nil {
+		return sess
+	}
+	m.put(*id, sess)
+	return sess
+}
+
+// Evict removes session from the cache, must be called on logout
+func (m *Manager) Evict(id *session.ID) {
+	if id == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.items[*id]; ok {
+		m.remove(el)
+	}
+}
+
+// Len returns count of cached sessions
+func (m *Manager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+func (m *Manager) get(key session.ID) (*session.Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if time.Now().After(e.expires) {
+		m.remove(el)
+		return nil, false
+	}
+	m.lru.MoveToFront(el)
+	return e.sess, true
+}
+
+func (m *Manager) put(key session.ID, sess *session.Session) {
+	ttl := m.ttl
+	if sess == nil {
+		ttl = m.negTTL
+	}
+	if ttl <= 0 || m.size <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expires := time.Now().Add(ttl)
+	if el, ok := m.items[key]; ok {
+		e := el.Value.(*entry)
+		e.sess = sess
+		e.expires = expires
+		m.lru.MoveToFront(el)
+		return
+	}
+	m.items[key] = m.lru.PushFront(&entry{key: key, sess: sess, expires: expires})
+	for m.lru.Len() > m.size {
+		m.remove(m.lru.Back())
+	}
+}
+
+func (m *Manager) remove(el *list.Element) {
+	m.lru.Remove(el)
+	delete(m.items, el.Value.(*entry).key)
+}
+
+func (m *Manager) observe(result string) {
+	if m.mLookup == nil {
+		return
+	}
+	m.mLookup.WithLabelValues(result).Inc()
+}
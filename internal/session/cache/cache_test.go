@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.countmax.ru/countmax/wda.back/internal/session"
+)
+
+type fakeManager struct {
+	calls    int
+	sessions map[string]*session.Session
+}
+
+func (f *fakeManager) Check(_ context.Context, id *session.ID) *session.Session {
+	f.calls++
+	return f.sessions[id.ID]
+}
+
+func TestManager_Check(t *testing.T) {
+	ctx := context.Background()
+	next := &fakeManager{sessions: map[string]*session.Session{
+		"a": {UID: "1"},
+		"b": {UID: "2"},
+	}}
+	m := New(next, 1, time.Hour, time.Hour, nil)
+	idA := &session.ID{ID: "a", Src: session.FromCookie}
+	idB := &session.ID{ID: "b", Src: session.FromCookie}
+
+	if got := m.Check(ctx, idA); got == nil || got.UID != "1" {
+		t.Fatalf("Manager.Check(a) = %+v, want UID 1", got)
+	}
+	_ = m.Check(ctx, idA)
+	if next.calls != 1 {
+		t.Errorf("second Check(a) must be served from cache, calls = %d", next.calls)
+	}
+	// size=1, b evicts a
+	_ = m.Check(ctx, idB)
+	_ = m.Check(ctx, idA)
+	if next.calls != 3 {
+		t.Errorf("Check(a) after eviction must call next, calls = %d", next.calls)
+	}
+	m.Evict(idA)
+	if m.Len() != 0 {
+		t.Errorf("Manager.Len() after Evict = %d, want 0", m.Len())
+	}
+	// same token from other source is the other key
+	_ = m.Check(ctx, &session.ID{ID: "a", Src: session.FromBearer})
+	if next.calls != 4 {
+		t.Errorf("Check(a, bearer) must call next, calls = %d", next.calls)
+	}
+}
+
+func TestManager_CheckNegative(t *testing.T) {
+	ctx := context.Background()
+	next := &fakeManager{}
+	id := &session.ID{ID: "x"}
+
+	m := New(next, 10, time.Hour, 0, nil)
+	_ = m.Check(ctx, id)
+	_ = m.Check(ctx, id)
+	if next.calls != 2 {
+		t.Errorf("not found sessions must not be cached with negTTL=0, calls = %d", next.calls)
+	}
+
+	next.calls = 0
+	m = New(next, 10, time.Hour, time.Hour, nil)
+	_ = m.Check(ctx, id)
+	_ = m.Check(ctx, id)
+	if next.calls != 1 {
+		t.Errorf("not found sessions must be cached with negTTL>0, calls = %d", next.calls)
+	}
+}
+
+func TestManager_CheckCanceled(t *testing.T) {
+	next := &fakeManager{}
+	id := &session.ID{ID: "x"}
+	m := New(next, 10, time.Hour, time.Hour, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = m.Check(ctx, id)
+	if m.Len() != 0 {
+		t.Errorf("result of the canceled lookup must not be cached, Manager.Len() = %d", m.Len())
+	}
+}
@@ -0,0 +1,119 @@
+// Package local contains session manager which issues sessions by itself,
+// used when wda.back authenticates users against own user repository
+package local
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"git.countmax.ru/countmax/wda.back/internal/session"
+)
+
+const tokenLen int = 32
+
+// ErrEmptySession error about attempt to issue nil session
+var ErrEmptySession = errors.New("empty session")
+
+type item struct {
+	sess    *session.Session
+	expires time.Time
+}
+
+// Manager keeps issued sessions in the memory,
+// sessions unknown to the Manager are checked by the wrapped manager
+type Manager struct {
+	session.ManagerInterface
+	ttl   time.Duration
+	mu    sync.RWMutex
+	items map[string]item
+}
+
+// New makes new instance of the Manager, next - wrapped manager, ttl - lifetime of issued sessions
+func New(next session.ManagerInterface, ttl time.Duration) *Manager {
+	return &Manager{
+		ManagerInterface: next,
+		ttl:              ttl,
+		items:            make(map[string]item),
+	}
+}
+
+// TTL returns lifetime of issued sessions
+func (m *Manager) TTL() time.Duration {
+	return m.ttl
+}
+
+// Create issues new session and returns its token
+func (m *Manager) Create(sess *session.Session) (string, error) {
+	if sess == nil {
+		return "", ErrEmptySession
+	}
+	buf := make([]byte, tokenLen)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	m.mu.Lock()
+	m.items[token] = item{sess: sess, expires: time.Now().Add(m.ttl)}
+	m.mu.Unlock()
+	return token, nil
+}
+
+// Run drops expired sessions every period until ctx is done
+func (m *Manager) Run(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.sweep(now)
+		}
+	}
+}
+
+// sweep drops sessions expired at the moment now
+func (m *Manager) sweep(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, v := range m.items {
+		if now.After(v.expires) {
+			delete(m.items, k)
+		}
+	}
+}
+
+// Check returns session by id or nil if session not found or expired or ctx is done
+func (m *Manager) Check(ctx context.Context, id *session.ID) *session.Session {
+	if id == nil || id.ID == "" || ctx.Err() != nil {
+		return nil
+	}
+	m.mu.RLock()
+	it, ok := m.items[id.ID]
+	m.mu.RUnlock()
+	if ok {
+		if time.Now().After(it.expires) {
+			m.Delete(id)
+			return nil
+		}
+		return it.sess
+	}
+	if m.ManagerInterface == nil {
+		return nil
+	}
+	return m.ManagerInterface.Check(ctx, id)
+}
+
+// Delete removes issued session
+func (m *Manager) Delete(id *session.ID) {
+	if id == nil {
+		return
+	}
+	m.mu.Lock()
+	delete(m.items, id.ID)
+	m.mu.Unlock()
+}
@@ -0,0 +1,54 @@
+package local
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.countmax.ru/countmax/wda.back/internal/session"
+)
+
+func TestManager_CreateCheckDelete(t *testing.T) {
+	ctx := context.Background()
+	m := New(nil, time.Hour)
+	sess := &session.Session{UID: "1", Login: "admin"}
+	token, err := m.Create(sess)
+	if err != nil {
+		t.Fatalf("Manager.Create() error = %v", err)
+	}
+	id := &session.ID{ID: token, Src: session.FromCookie}
+	if got := m.Check(ctx, id); got != sess {
+		t.Errorf("Manager.Check() = %+v, want %+v", got, sess)
+	}
+	m.Delete(id)
+	if got := m.Check(ctx, id); got != nil {
+		t.Errorf("Manager.Check() after Delete = %+v, want nil", got)
+	}
+}
+
+func TestManager_CheckExpired(t *testing.T) {
+	ctx := context.Background()
+	m := New(nil, -time.Second)
+	token, err := m.Create(&session.Session{UID: "1"})
+	if err != nil {
+		t.Fatalf("Manager.Create() error = %v", err)
+	}
+	if got := m.Check(ctx, &session.ID{ID: token}); got != nil {
+		t.Errorf("Manager.Check() expired = %+v, want nil", got)
+	}
+}
+
+func TestManager_sweep(t *testing.T) {
+	m := New(nil, time.Hour)
+	if _, err := m.Create(&session.Session{UID: "1"}); err != nil {
+		t.Fatalf("Manager.Create() error = %v", err)
+	}
+	m.sweep(time.Now())
+	if len(m.items) != 1 {
+		t.Errorf("Manager.sweep() dropped alive session")
+	}
+	m.sweep(time.Now().Add(2 * time.Hour))
+	if len(m.items) != 0 {
+		t.Errorf("Manager.sweep() kept %d expired sessions", len(m.items))
+	}
+}
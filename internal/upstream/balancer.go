@@ -0,0 +1,274 @@
+// Package upstream contains health-aware round-robin balancer of the proxied upstream targets
+package upstream
+
+import (
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// MetaHealth key of the ProxyTarget.Meta with base url of the target health check
+const MetaHealth string = "health"
+
+type target struct {
+	*middleware.ProxyTarget
+	healthy   bool
+	fails     int
+	successes int
+	cb        breaker
+}
+
+// Balancer implements middleware.ProxyBalancer, round-robin over healthy targets;
+// target is ejected after unhealthy consecutive failed checks
+// and re-admitted after healthy consecutive successful checks;
+// if circuit breaker is set, targets with open circuit are skipped
+type Balancer struct {
+	unhealthy  int
+	healthy    int
+	cbFails    int
+	cbCooldown time.Duration
+	onState    func(name string, st State)
+	mu         sync.RWMutex
+	targets    []*target
+	i          uint32
+}
+
+// NewBalancer makes new instance of the Balancer with thresholds of ejection and re-admission,
+// thresholds less than 1 are treated as 1
+func NewBalancer(unhealthy, healthy int) *Balancer {
+	if unhealthy < 1 {
+		unhealthy = 1
+	}
+	if healthy < 1 {
+		healthy = 1
+	}
+	return &Balancer{unhealthy: unhealthy, healthy: healthy}
+}
+
+// SetBreaker enables circuit breaker of the targets, circuit opens after fails consecutive
+// failed requests and becomes half-open after cooldown; onState is called on state change, may be nil
+func (b *Balancer) SetBreaker(fails int, cooldown time.Duration, onState func(name string, st State)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cbFails = fails
+	b.cbCooldown = cooldown
+	b.onState = onState
+}
+
+// AddTarget adds healthy target, returns false if target with the same name exists
+func (b *Balancer) AddTarget(pt *middleware.ProxyTarget) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, t := range b.targets {
+		if t.Name == pt.Name {
+			return false
+		}
+	}
+	b.targets = append(b.targets, &target{ProxyTarget: pt, healthy: true})
+	return true
+}
+
+// RemoveTarget removes target by name
+func (b *Balancer) RemoveTarget(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, t := range b.targets {
+		if t.Name == name {
+			b.targets = append(b.targets[:i], b.targets[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns next healthy target with not open circuit,
+// if there are no such targets returns healthy target or any target,
+// nil if there are no targets at all
+func (b *Balancer) Next(echo.Context) *middleware.ProxyTarget {
+	return b.NextExcept(nil)
+}
+
+// NextExcept returns next target like Next but skips targets with names from the except
+func (b *Balancer) NextExcept(except map[string]bool) *middleware.ProxyTarget {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	n := uint32(len(b.targets))
+	if n == 0 {
+		return nil
+	}
+	now := time.Now()
+	start := atomic.AddUint32(&b.i, 1)
+	var healthy, fallback *target
+	for j := uint32(0); j < n; j++ {
+		t := b.targets[(start+j)%n]
+		if except[t.Name] {
+			continue
+		}
+		if fallback == nil {
+			fallback = t
+		}
+		if !t.healthy {
+			continue
+		}
+		if b.cbFails <= 0 || t.cb.ready(b.cbCooldown, now) {
+			return t.ProxyTarget
+		}
+		if healthy == nil {
+			healthy = t
+		}
+	}
+	switch {
+	case healthy != nil:
+		return healthy.ProxyTarget
+	case fallback != nil:
+		return fallback.ProxyTarget
+	default:
+		return nil
+	}
+}
+
+// Lookup returns target by scheme and host of the url
+func (b *Balancer) Lookup(u *url.URL) *middleware.ProxyTarget {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, t := range b.targets {
+		if t.URL.Scheme == u.Scheme && t.URL.Host == u.Host {
+			return t.ProxyTarget
+		}
+	}
+	return nil
+}
+
+// Allow returns true if request can be sent to the target,
+// open circuit after cooldown becomes half-open and allows single probe request
+func (b *Balancer) Allow(name string) bool {
+	b.mu.Lock()
+	if b.cbFails <= 0 {
+		b.mu.Unlock()
+		return true
+	}
+	var (
+		allowed, changed bool
+		st               State
+	)
+	for _, t := range b.targets {
+		if t.Name == name {
+			allowed, changed = t.cb.allow(b.cbCooldown, time.Now())
+			st = t.cb.state
+			break
+		}
+	}
+	onState := b.onState
+	b.mu.Unlock()
+	if changed && onState != nil {
+		onState(name, st)
+	}
+	return allowed
+}
+
+// Done registers result of the request to the target for the circuit breaker
+func (b *Balancer) Done(name string, err error) {
+	b.mu.Lock()
+	if b.cbFails <= 0 {
+		b.mu.Unlock()
+		return
+	}
+	var (
+		changed bool
+		st      State
+	)
+	for _, t := range b.targets {
+		if t.Name == name {
+			changed = t.cb.done(err, b.cbFails, time.Now())
+			st = t.cb.state
+			break
+		}
+	}
+	onState := b.onState
+	b.mu.Unlock()
+	if changed && onState != nil {
+		onState(name, st)
+	}
+}
+
+// Cancel registers request to the target canceled by the client,
+// it isn't counted by the circuit breaker, half-open circuit is opened back for the cooldown
+func (b *Balancer) Cancel(name string) {
+	b.mu.Lock()
+	if b.cbFails <= 0 {
+		b.mu.Unlock()
+		return
+	}
+	var (
+		changed bool
+		st      State
+	)
+	for _, t := range b.targets {
+		if t.Name == name {
+			changed = t.cb.cancel(time.Now())
+			st = t.cb.state
+			break
+		}
+	}
+	onState := b.onState
+	b.mu.Unlock()
+	if changed && onState != nil {
+		onState(name, st)
+	}
+}
+
+// Targets returns snapshot of the targets
+func (b *Balancer) Targets() []*middleware.ProxyTarget {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	res := make([]*middleware.ProxyTarget, len(b.targets))
+	for i, t := range b.targets {
+		res[i] = t.ProxyTarget
+	}
+	return res
+}
+
+// Healthy returns health state of the target by name
+func (b *Balancer) Healthy(name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, t := range b.targets {
+		if t.Name == name {
+			return t.healthy
+		}
+	}
+	return false
+}
+
+// Report registers result of the health check of the target,
+// returns current health state and true if the state has been changed
+func (b *Balancer) Report(name string, err error) (healthy, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, t := range b.targets {
+		if t.Name != name {
+			continue
+		}
+		if err != nil {
+			t.successes = 0
+			t.fails++
+			if t.healthy && t.fails >= b.unhealthy {
+				t.healthy = false
+				return false, true
+			}
+			return t.healthy, false
+		}
+		t.fails = 0
+		t.successes++
+		if !t.healthy && t.successes >= b.healthy {
+			t.healthy = true
+			return true, true
+		}
+		return t.healthy, false
+	}
+	return false, false
+}
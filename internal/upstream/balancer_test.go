@@ -0,0 +1,64 @@
+package upstream
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/labstack/echo/v4/middleware"
+)
+
+func makeTarget(t *testing.T, raw string) *middleware.ProxyTarget {
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &middleware.ProxyTarget{Name: raw, URL: u}
+}
+
+func TestBalancer_EjectAndReadmit(t *testing.T) {
+	b := NewBalancer(2, 1)
+	a := makeTarget(t, "http://a:9001")
+	c := makeTarget(t, "http://c:9001")
+	if !b.AddTarget(a) || !b.AddTarget(c) || b.AddTarget(a) {
+		t.Fatalf("Balancer.AddTarget() must add unique targets only")
+	}
+	errDown := errors.New("down")
+	if _, changed := b.Report(a.Name, errDown); changed {
+		t.Errorf("target must not be ejected before threshold")
+	}
+	if healthy, changed := b.Report(a.Name, errDown); healthy || !changed {
+		t.Errorf("Balancer.Report() = %v, %v, want ejection", healthy, changed)
+	}
+	for i := 0; i < 4; i++ {
+		if got := b.Next(nil); got != c {
+			t.Errorf("Balancer.Next() = %s, want only healthy %s", got.Name, c.Name)
+		}
+	}
+	if healthy, changed := b.Report(a.Name, nil); !healthy || !changed {
+		t.Errorf("Balancer.Report() = %v, %v, want re-admission", healthy, changed)
+	}
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[b.Next(nil).Name]++
+	}
+	if seen[a.Name] != 2 || seen[c.Name] != 2 {
+		t.Errorf("Balancer.Next() must round-robin healthy targets, got %v", seen)
+	}
+}
+
+func TestBalancer_NoHealthy(t *testing.T) {
+	b := NewBalancer(1, 1)
+	if got := b.Next(nil); got != nil {
+		t.Errorf("Balancer.Next() without targets = %v, want nil", got)
+	}
+	a := makeTarget(t, "http://a:9001")
+	b.AddTarget(a)
+	b.Report(a.Name, errors.New("down"))
+	if got := b.Next(nil); got != a {
+		t.Errorf("Balancer.Next() without healthy targets must return any target")
+	}
+	if !b.RemoveTarget(a.Name) || len(b.Targets()) != 0 {
+		t.Errorf("Balancer.RemoveTarget() must remove target")
+	}
+}
@@ -0,0 +1,96 @@
+package upstream
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrCircuitOpen request isn't sent because circuit breaker of the target is open
+var ErrCircuitOpen = errors.New("upstream circuit breaker is open")
+
+// State state of the circuit breaker
+type State int
+
+const (
+	// StateClosed requests pass to the target
+	StateClosed State = iota
+	// StateHalfOpen single probe request passes to the target
+	StateHalfOpen
+	// StateOpen requests don't pass to the target
+	StateOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateHalfOpen:
+		return "half-open"
+	case StateOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker circuit breaker of the target, opens after threshold consecutive failures,
+// becomes half-open after cooldown, closes after successful probe
+type breaker struct {
+	state    State
+	fails    int
+	openedAt time.Time
+}
+
+// ready returns true if request can be sent, doesn't change state
+func (cb *breaker) ready(cooldown time.Duration, now time.Time) bool {
+	switch cb.state {
+	case StateClosed:
+		return true
+	case StateOpen:
+		return now.Sub(cb.openedAt) >= cooldown
+	default:
+		return false
+	}
+}
+
+// allow returns true if request can be sent, open breaker after cooldown becomes half-open
+func (cb *breaker) allow(cooldown time.Duration, now time.Time) (allowed, changed bool) {
+	if !cb.ready(cooldown, now) {
+		return false, false
+	}
+	if cb.state == StateOpen {
+		cb.state = StateHalfOpen
+		return true, true
+	}
+	return true, false
+}
+
+// done registers result of the request, returns true if state has been changed
+func (cb *breaker) done(err error, threshold int, now time.Time) bool {
+	if err == nil {
+		cb.fails = 0
+		if cb.state != StateClosed {
+			cb.state = StateClosed
+			return true
+		}
+		return false
+	}
+	cb.fails++
+	if cb.state == StateHalfOpen || (cb.state == StateClosed && cb.fails >= threshold) {
+		cb.state = StateOpen
+		cb.openedAt = now
+		return true
+	}
+	return false
+}
+
+// cancel releases probe of the half-open breaker without result, breaker is opened again
+// and next request probes after cooldown from now, returns true if state has been changed
+func (cb *breaker) cancel(now time.Time) bool {
+	if cb.state != StateHalfOpen {
+		return false
+	}
+	cb.state = StateOpen
+	cb.openedAt = now
+	return true
+}
@@ -0,0 +1,153 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWaitTime  time.Duration = 5 * time.Minute
+	defaultRetryWait time.Duration = 5 * time.Second
+)
+
+// WatcherConfig defines what service instances are resolved in consul
+type WatcherConfig struct {
+	Service   string        // consul service name
+	Tag       string        // consul service tag, empty - any
+	Scheme    string        // scheme of the target url, http if empty
+	APIPort   int           // port of the api if instances are registered by the health check port, 0 - service port
+	WaitTime  time.Duration // max duration of the blocking query
+	RetryWait time.Duration // pause after failed query
+}
+
+// Watcher keeps balancer targets in sync with passing instances of the consul service
+type Watcher struct {
+	cfg      WatcherConfig
+	health   *consulapi.Health
+	balancer *Balancer
+	log      *zap.SugaredLogger
+	// OnUpdate is called after targets were added or removed, may be nil
+	OnUpdate func(added, removed []string)
+}
+
+// NewWatcher makes new instance of the Watcher
+func NewWatcher(client *consulapi.Client, cfg WatcherConfig, b *Balancer, log *zap.SugaredLogger) *Watcher {
+	if cfg.Scheme == "" {
+		cfg.Scheme = "http"
+	}
+	if cfg.WaitTime <= 0 {
+		cfg.WaitTime = defaultWaitTime
+	}
+	if cfg.RetryWait <= 0 {
+		cfg.RetryWait = defaultRetryWait
+	}
+	return &Watcher{
+		cfg:      cfg,
+		health:   client.Health(),
+		balancer: b,
+		log:      log.With(zap.String("consul_service", cfg.Service)),
+	}
+}
+
+// Sync makes single query of the instances and updates balancer, returns consul index
+func (w *Watcher) Sync(ctx context.Context, waitIndex uint64) (uint64, error) {
+	q := (&consulapi.QueryOptions{WaitIndex: waitIndex, WaitTime: w.cfg.WaitTime}).WithContext(ctx)
+	entries, meta, err := w.health.Service(w.cfg.Service, w.cfg.Tag, true, q)
+	if err != nil {
+		return waitIndex, err
+	}
+	targets := make(map[string]*middleware.ProxyTarget, len(entries))
+	for _, e := range entries {
+		pt, err := w.target(e)
+		if err != nil {
+			w.log.Errorf("skip consul instance, %v", err)
+			continue
+		}
+		targets[pt.Name] = pt
+	}
+	w.update(targets)
+	return meta.LastIndex, nil
+}
+
+// Run watches the service by blocking queries until ctx is done
+func (w *Watcher) Run(ctx context.Context) {
+	w.log.Debugf("starting consul watcher")
+	defer w.log.Debugf("stopped consul watcher")
+	var index uint64
+	for {
+		next, err := w.Sync(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			w.log.Errorf("consul query error, %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.cfg.RetryWait):
+			}
+			continue
+		}
+		// index went backwards, consul recommends to reset it
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+func (w *Watcher) target(e *consulapi.ServiceEntry) (*middleware.ProxyTarget, error) {
+	if e.Service == nil {
+		return nil, fmt.Errorf("empty service entry")
+	}
+	host := e.Service.Address
+	if host == "" && e.Node != nil {
+		host = e.Node.Address
+	}
+	if host == "" {
+		return nil, fmt.Errorf("instance %s without address", e.Service.ID)
+	}
+	port := e.Service.Port
+	if w.cfg.APIPort > 0 {
+		port = w.cfg.APIPort
+	}
+	u := &url.URL{Scheme: w.cfg.Scheme, Host: net.JoinHostPort(host, strconv.Itoa(port))}
+	health := url.URL{Scheme: w.cfg.Scheme, Host: net.JoinHostPort(host, strconv.Itoa(e.Service.Port))}
+	return &middleware.ProxyTarget{
+		Name: u.String(),
+		URL:  u,
+		Meta: echo.Map{MetaHealth: health.String()},
+	}, nil
+}
+
+func (w *Watcher) update(targets map[string]*middleware.ProxyTarget) {
+	var added, removed []string
+	current := make(map[string]bool)
+	for _, pt := range w.balancer.Targets() {
+		current[pt.Name] = true
+		if _, ok := targets[pt.Name]; !ok && w.balancer.RemoveTarget(pt.Name) {
+			removed = append(removed, pt.Name)
+		}
+	}
+	for name, pt := range targets {
+		if !current[name] && w.balancer.AddTarget(pt) {
+			added = append(added, name)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	w.log.Infof("upstream targets updated, added=%v, removed=%v", added, removed)
+	if w.OnUpdate != nil {
+		w.OnUpdate(added, removed)
+	}
+}
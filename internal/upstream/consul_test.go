@@ -0,0 +1,121 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"go.uber.org/zap"
+)
+
+// fakeConsul serves /v1/health/service/{name}, every blocking query returns next state
+type fakeConsul struct {
+	mu     sync.Mutex
+	states [][]*consulapi.ServiceEntry
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/v1/health/service/layoutconfig.api") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Query().Get("passing") == "" {
+		http.Error(w, "passing only expected", http.StatusBadRequest)
+		return
+	}
+	index := 0
+	if v := r.URL.Query().Get("index"); v != "" {
+		index, _ = strconv.Atoi(v)
+	}
+	f.mu.Lock()
+	last := len(f.states) - 1
+	f.mu.Unlock()
+	if index > last {
+		// nothing changed, hold the blocking query
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		index = last
+	}
+	f.mu.Lock()
+	state := f.states[index]
+	f.mu.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.Itoa(index+1))
+	_ = json.NewEncoder(w).Encode(state)
+}
+
+func entry(id, addr string, port int) *consulapi.ServiceEntry {
+	return &consulapi.ServiceEntry{
+		Node:    &consulapi.Node{Address: "10.0.0.1"},
+		Service: &consulapi.AgentService{ID: id, Service: "layoutconfig.api", Address: addr, Port: port},
+	}
+}
+
+func targetNames(b *Balancer) []string {
+	var names []string
+	for _, pt := range b.Targets() {
+		names = append(names, pt.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestWatcher_Run(t *testing.T) {
+	fake := &fakeConsul{states: [][]*consulapi.ServiceEntry{
+		{entry("a", "a.local", 9002), entry("b", "b.local", 9002)},
+		{entry("b", "b.local", 9002), entry("c", "", 9002)},
+	}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	cfg := consulapi.DefaultConfig()
+	cfg.Address = strings.TrimPrefix(srv.URL, "http://")
+	client, err := consulapi.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBalancer(1, 1)
+	w := NewWatcher(client, WatcherConfig{Service: "layoutconfig.api", APIPort: 9001, WaitTime: time.Second}, b, zap.NewNop().Sugar())
+	var mu sync.Mutex
+	var removed []string
+	w.OnUpdate = func(_, r []string) {
+		mu.Lock()
+		removed = append(removed, r...)
+		mu.Unlock()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	want := []string{"http://10.0.0.1:9001", "http://b.local:9001"}
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		got := targetNames(b)
+		if strings.Join(got, ",") == strings.Join(want, ",") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("balancer targets = %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(removed) != 1 || removed[0] != "http://a.local:9001" {
+		t.Errorf("removed targets = %v, want [http://a.local:9001]", removed)
+	}
+	for _, pt := range b.Targets() {
+		if h := pt.Meta[MetaHealth]; !strings.HasSuffix(h.(string), ":9002") {
+			t.Errorf("health url of %s = %v, want service port 9002", pt.Name, h)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package upstream
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Transport sends proxied requests to the balancer targets,
+// idempotent requests failed by network error or 502/503/504 are retried against another target;
+// results are registered in the circuit breakers of the targets
+type Transport struct {
+	Balancer *Balancer
+	Base     http.RoundTripper // http.DefaultTransport if nil
+	Retries  int               // max count of retries
+	Backoff  time.Duration     // pause before the first retry, doubled for every next retry
+	// OnRetry is called before retry, may be nil
+	OnRetry func(from, to string)
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	cur := t.Balancer.Lookup(req.URL)
+	if cur == nil {
+		return base.RoundTrip(req)
+	}
+	idempotent := (req.Method == http.MethodGet || req.Method == http.MethodHead) &&
+		(req.Body == nil || req.Body == http.NoBody)
+	tried := make(map[string]bool)
+	backoff := t.Backoff
+	for attempt := 0; ; attempt++ {
+		last := !idempotent || attempt >= t.Retries
+		resp, err := t.try(base, req, cur.Name, last)
+		if err == nil && resp != nil {
+			return resp, nil
+		}
+		tried[cur.Name] = true
+		if last || req.Context().Err() != nil {
+			return resp, err
+		}
+		next := t.Balancer.NextExcept(tried)
+		if next == nil {
+			return resp, err
+		}
+		if backoff > 0 {
+			select {
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		if t.OnRetry != nil {
+			t.OnRetry(cur.Name, next.Name)
+		}
+		req = retarget(req, cur.URL.Path, next)
+		cur = next
+	}
+}
+
+// try sends request to the target, failed response is returned only for the last attempt
+func (t *Transport) try(base http.RoundTripper, req *http.Request, name string, last bool) (*http.Response, error) {
+	if !t.Balancer.Allow(name) {
+		return nil, fmt.Errorf("%s, %w", name, ErrCircuitOpen)
+	}
+	resp, err := base.RoundTrip(req)
+	if req.Context().Err() != nil {
+		// canceled by the client, the target isn't to blame
+		t.Balancer.Cancel(name)
+		return resp, err
+	}
+	if err != nil {
+		t.Balancer.Done(name, err)
+		return nil, err
+	}
+	if !retryableStatus(resp.StatusCode) {
+		t.Balancer.Done(name, nil)
+		return resp, nil
+	}
+	t.Balancer.Done(name, fmt.Errorf("%s responded %d", name, resp.StatusCode))
+	if last {
+		return resp, nil
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return nil, fmt.Errorf("%s responded %d", name, resp.StatusCode)
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// retarget makes copy of the request to the next target, base path of the previous target is replaced
+func retarget(req *http.Request, prevPath string, next *middleware.ProxyTarget) *http.Request {
+	r := req.Clone(req.Context())
+	r.URL.Scheme = next.URL.Scheme
+	r.URL.Host = next.URL.Host
+	path := strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(prevPath, "/"))
+	r.URL.Path = strings.TrimSuffix(next.URL.Path, "/") + path
+	r.URL.RawPath = ""
+	return r
+}
@@ -0,0 +1,135 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4/middleware"
+)
+
+func TestTransport_RoundTrip(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/layouts" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+
+	b := NewBalancer(1, 1)
+	downTarget := makeTarget(t, down.URL+"/api")
+	b.AddTarget(downTarget)
+	b.AddTarget(makeTarget(t, up.URL+"/api"))
+	states := make(map[string]State)
+	b.SetBreaker(1, time.Hour, func(name string, st State) { states[name] = st })
+	retries := 0
+	tr := &Transport{Balancer: b, Retries: 1, OnRetry: func(_, _ string) { retries++ }}
+
+	// POST isn't retried, upstream response is returned as is
+	resp, err := tr.RoundTrip(httptest.NewRequest(http.MethodPost, down.URL+"/api/layouts", nil))
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("POST RoundTrip() = %v, %v, want 503 from upstream", resp, err)
+	}
+	if states[downTarget.Name] != StateOpen {
+		t.Errorf("circuit of %s = %s, want open", downTarget.Name, states[downTarget.Name])
+	}
+	// GET to the open circuit is retried against another target
+	resp, err = tr.RoundTrip(httptest.NewRequest(http.MethodGet, down.URL+"/api/layouts", nil))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET RoundTrip() = %v, %v, want 200 from another target", resp, err)
+	}
+	if retries != 1 {
+		t.Errorf("retries = %d, want 1", retries)
+	}
+	// POST to the open circuit fails fast
+	_, err = tr.RoundTrip(httptest.NewRequest(http.MethodPost, down.URL+"/api/layouts", nil))
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("POST RoundTrip() to open circuit error = %v, want %v", err, ErrCircuitOpen)
+	}
+	// balancer skips open circuit
+	for i := 0; i < 3; i++ {
+		if got := b.Next(nil); got.Name == downTarget.Name {
+			t.Errorf("Balancer.Next() = %s, target with open circuit must be skipped", got.Name)
+		}
+	}
+}
+
+func TestBreaker_HalfOpen(t *testing.T) {
+	cb := &breaker{}
+	now := time.Now()
+	errFail := errors.New("fail")
+	if cb.done(errFail, 2, now) || cb.state != StateClosed {
+		t.Fatalf("breaker must stay closed before threshold")
+	}
+	if !cb.done(errFail, 2, now) || cb.state != StateOpen {
+		t.Fatalf("breaker must open after threshold")
+	}
+	if allowed, _ := cb.allow(time.Minute, now); allowed {
+		t.Errorf("open breaker must not allow requests before cooldown")
+	}
+	if allowed, changed := cb.allow(time.Minute, now.Add(time.Minute)); !allowed || !changed || cb.state != StateHalfOpen {
+		t.Errorf("breaker must become half-open after cooldown")
+	}
+	if allowed, _ := cb.allow(time.Minute, now.Add(time.Minute)); allowed {
+		t.Errorf("half-open breaker must allow single probe")
+	}
+	if !cb.cancel(now.Add(time.Minute)) || cb.state != StateOpen {
+		t.Errorf("canceled probe must open breaker back")
+	}
+	if allowed, _ := cb.allow(time.Minute, now.Add(time.Minute)); allowed {
+		t.Errorf("breaker must not allow probe before cooldown after canceled probe")
+	}
+	if allowed, _ := cb.allow(time.Minute, now.Add(2*time.Minute)); !allowed {
+		t.Errorf("breaker must allow probe after cooldown after canceled probe")
+	}
+	if !cb.done(nil, 2, now) || cb.state != StateClosed {
+		t.Errorf("breaker must close after successful probe")
+	}
+}
+
+func TestTransport_RoundTripCanceled(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+
+	b := NewBalancer(1, 1)
+	target := makeTarget(t, slow.URL+"/api")
+	b.AddTarget(target)
+	b.AddTarget(makeTarget(t, slow.URL+"/api2"))
+	b.SetBreaker(1, time.Hour, nil)
+	retries := 0
+	tr := &Transport{Balancer: b, Retries: 1, OnRetry: func(_, _ string) { retries++ }}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, slow.URL+"/api/layouts", nil).WithContext(ctx)
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Fatalf("RoundTrip() of canceled request must fail")
+	}
+	if retries != 0 {
+		t.Errorf("canceled request must not be retried, retries = %d", retries)
+	}
+	if !b.Allow(target.Name) {
+		t.Errorf("canceled request must not be counted by the circuit breaker")
+	}
+}
+
+func TestRetarget(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://a:9001/api/layouts?id=1", nil)
+	u, _ := url.Parse("http://b:9002/v2")
+	got := retarget(req, "/api", &middleware.ProxyTarget{Name: u.String(), URL: u})
+	if got.URL.String() != "http://b:9002/v2/layouts?id=1" {
+		t.Errorf("retarget() = %s, want http://b:9002/v2/layouts?id=1", got.URL.String())
+	}
+}
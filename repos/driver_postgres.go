@@ -0,0 +1,17 @@
+package repos
+
+import (
+	"errors"
+
+	"github.com/jackc/pgconn"
+	// PostgreSQL driver of the users.source postgres
+	_ "github.com/jackc/pgx/v4/stdlib"
+)
+
+const pgUniqueViolation string = "23505"
+
+// pgIsUniqueViolation returns true if err is violation of the unique constraint
+func pgIsUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation
+}
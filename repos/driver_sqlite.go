@@ -0,0 +1,15 @@
+package repos
+
+import (
+	"errors"
+
+	// pure go SQLite driver of the users.source sqlite, works with CGO_ENABLED=0
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteIsUniqueViolation returns true if err is violation of the unique constraint
+func sqliteIsUniqueViolation(err error) bool {
+	var sqErr *sqlite.Error
+	return errors.As(err, &sqErr) && sqErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
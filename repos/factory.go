@@ -0,0 +1,50 @@
+package repos
+
+import (
+	"fmt"
+	"time"
+
+	"git.countmax.ru/countmax/wda.back/domain"
+	"go.uber.org/zap"
+)
+
+// sources of the users repository
+const (
+	SourceCountmax string = "countmax"
+	SourcePostgres string = "postgres"
+	SourceSQLite   string = "sqlite"
+	SourceMemory   string = "memory"
+)
+
+// Config of the users repository
+type Config struct {
+	Source  string        // countmax, postgres, sqlite or memory; countmax if empty
+	DSN     string        // connection string of the source
+	Timeout time.Duration // timeout of every repository call
+	Seed    domain.Users  // initial users of the memory source, PWord is plain password
+}
+
+// New makes users repository of the source
+func New(cfg Config, logger *zap.SugaredLogger) (domain.UserRepoI, error) {
+	switch cfg.Source {
+	case SourceCountmax, "":
+		return NewCMRepo(cfg.DSN, cfg.Timeout, logger)
+	case SourcePostgres:
+		return NewSQLRepo(Postgres, cfg.DSN, cfg.Timeout, logger)
+	case SourceSQLite:
+		return NewSQLRepo(SQLite, cfg.DSN, cfg.Timeout, logger)
+	case SourceMemory:
+		seed := make(domain.Users, len(cfg.Seed))
+		for i, u := range cfg.Seed {
+			hash, err := hashPass(u.PWord)
+			if err != nil {
+				return nil, err
+			}
+			u.PWord = hash
+			seed[i] = u
+		}
+		return NewMemRepo(seed...)
+	default:
+		return nil, fmt.Errorf("unknown users.source %s", cfg.Source)
+	}
+}
@@ -0,0 +1,175 @@
+package repos
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"git.countmax.ru/countmax/wda.back/domain"
+)
+
+// MemRepo implementation of the domain.IUserRepo in memory, for tests and demo stands;
+// passwords are hashed like in the sql repos, so new passwords can't be checked by cmaxdb.UserСheckPass (see hashPass),
+// users are lost on restart
+type MemRepo struct {
+	domain.DefImplUserRepoI
+	mu     sync.RWMutex
+	lastID int64
+	users  map[int64]domain.User
+}
+
+// NewMemRepo makes new instance of the MemRepo with copies of users, their PWord must be hashed already;
+// users without id get next free one, duplicate logins or ids are rejected
+func NewMemRepo(users ...domain.User) (*MemRepo, error) {
+	r := &MemRepo{users: make(map[int64]domain.User, len(users))}
+	for _, u := range users {
+		if u.UserID > r.lastID {
+			r.lastID = u.UserID
+		}
+	}
+	for _, u := range users {
+		if _, ok := r.byLogin(u.Login); ok {
+			return nil, fmt.Errorf("seed user %s, %w", u.Login, ErrLoginExists)
+		}
+		if _, ok := r.users[u.UserID]; ok {
+			return nil, fmt.Errorf("seed user %s, duplicate id %d", u.Login, u.UserID)
+		}
+		if u.UserID == 0 {
+			r.lastID++
+			u.UserID = r.lastID
+		}
+		r.users[u.UserID] = u
+	}
+	return r, nil
+}
+
+// Login extract user by login and check pass;
+// if user not fond error, if pass not match error
+func (r *MemRepo) Login(ctx context.Context, uLogin, uPass string) (*domain.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	u, ok := r.byLogin(uLogin)
+	r.mu.RUnlock()
+	if !ok || !checkPass(u.PWord, uPass) {
+		return nil, ErrLoginPass
+	}
+	return &u, nil
+}
+
+// AddUser creates new user in the repo
+func (r *MemRepo) AddUser(ctx context.Context, u domain.User) (*domain.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	hash, err := hashPass(u.PWord)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byLogin(u.Login); ok {
+		return nil, ErrLoginExists
+	}
+	r.lastID++
+	u.UserID = r.lastID
+	stored := u
+	stored.PWord = hash
+	r.users[u.UserID] = stored
+	return &u, nil
+}
+
+// UserSetPass upd password for specified user id
+func (r *MemRepo) UserSetPass(ctx context.Context, id int64, pass string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	hash, err := hashPass(pass)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if u, ok := r.users[id]; ok {
+		u.PWord = hash
+		r.users[id] = u
+	}
+	return nil
+}
+
+// GetUsers extracts users from repo ordered by id
+func (r *MemRepo) GetUsers(ctx context.Context, offset, limit int64) (domain.Users, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	total := int64(len(r.users))
+	if offset >= total {
+		return nil, total, nil
+	}
+	ids := make([]int64, 0, total)
+	for id := range r.users {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	end := total
+	if limit >= 0 && limit < total-offset {
+		end = offset + limit
+	}
+	users := make(domain.Users, 0, end-offset)
+	for _, id := range ids[offset:end] {
+		u := r.users[id]
+		u.PWord = ""
+		users = append(users, u)
+	}
+	return users, total, nil
+}
+
+// GetUserByID extracts specified user from repo
+func (r *MemRepo) GetUserByID(ctx context.Context, id int64) (*domain.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	u, ok := r.users[id]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	u.PWord = ""
+	return &u, nil
+}
+
+// DelUser erase user record from repo
+func (r *MemRepo) DelUser(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	delete(r.users, id)
+	r.mu.Unlock()
+	return nil
+}
+
+// GetSrvPortDB returns memory
+func (r *MemRepo) GetSrvPortDB() string {
+	return SourceMemory
+}
+
+// HealthCheck memory is always available
+func (r *MemRepo) HealthCheck(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// byLogin finds user by login, must be called under lock
+func (r *MemRepo) byLogin(login string) (domain.User, bool) {
+	for _, u := range r.users {
+		if u.Login == login {
+			return u, true
+		}
+	}
+	return domain.User{}, false
+}
@@ -0,0 +1,150 @@
+package repos
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+
+	"git.countmax.ru/countmax/wda.back/domain"
+)
+
+func TestMemRepo_Login(t *testing.T) {
+	ctx := context.Background()
+	r, err := NewMemRepo()
+	if err != nil {
+		t.Fatalf("NewMemRepo() error = %v", err)
+	}
+	u, err := r.AddUser(ctx, domain.User{Login: "ivanov", PWord: "s3cret", UserFullName: "Иванов И.И."})
+	if err != nil {
+		t.Fatalf("AddUser() error = %v", err)
+	}
+	if u.UserID != 1 || u.PWord != "s3cret" {
+		t.Errorf("AddUser() = %+v, want id 1 and the request pword", u)
+	}
+	if _, err := r.AddUser(ctx, domain.User{Login: "ivanov", PWord: "other"}); !errors.Is(err, ErrLoginExists) {
+		t.Errorf("AddUser() of the same login error = %v, want %v", err, ErrLoginExists)
+	}
+	tests := []struct {
+		name    string
+		login   string
+		pass    string
+		wantErr error
+	}{
+		{"ok", "ivanov", "s3cret", nil},
+		{"wrong_pass", "ivanov", "wrong", ErrLoginPass},
+		{"unknown_login", "petrov", "s3cret", ErrLoginPass},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Login(ctx, tt.login, tt.pass)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Login() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got.UserID != u.UserID {
+				t.Errorf("Login() = %+v, want user %d", got, u.UserID)
+			}
+		})
+	}
+	if err := r.UserSetPass(ctx, u.UserID, "n3w"); err != nil {
+		t.Fatalf("UserSetPass() error = %v", err)
+	}
+	if _, err := r.Login(ctx, "ivanov", "s3cret"); !errors.Is(err, ErrLoginPass) {
+		t.Errorf("Login() with old pass error = %v, want %v", err, ErrLoginPass)
+	}
+	if _, err := r.Login(ctx, "ivanov", "n3w"); err != nil {
+		t.Errorf("Login() with new pass error = %v", err)
+	}
+}
+
+func TestMemRepo_GetUsers(t *testing.T) {
+	ctx := context.Background()
+	r, err := NewMemRepo(
+		domain.User{UserID: 10, Login: "admin", PWord: "hash"},
+		domain.User{Login: "user1"},
+		domain.User{Login: "user2"},
+	)
+	if err != nil {
+		t.Fatalf("NewMemRepo() error = %v", err)
+	}
+	tests := []struct {
+		name      string
+		offset    int64
+		limit     int64
+		wantIDs   []int64
+		wantTotal int64
+	}{
+		{"all", 0, 10, []int64{10, 11, 12}, 3},
+		{"page", 1, 1, []int64{11}, 3},
+		{"tail", 2, 10, []int64{12}, 3},
+		{"beyond", 5, 10, nil, 3},
+		{"max_limit", 1, math.MaxInt64, []int64{11, 12}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, total, err := r.GetUsers(ctx, tt.offset, tt.limit)
+			if err != nil {
+				t.Fatalf("GetUsers() error = %v", err)
+			}
+			if total != tt.wantTotal || len(users) != len(tt.wantIDs) {
+				t.Fatalf("GetUsers() = %d users of %d, want %d of %d", len(users), total, len(tt.wantIDs), tt.wantTotal)
+			}
+			for i, u := range users {
+				if u.UserID != tt.wantIDs[i] || u.PWord != "" {
+					t.Errorf("GetUsers()[%d] = %+v, want id %d without pword", i, u, tt.wantIDs[i])
+				}
+			}
+		})
+	}
+	u, err := r.GetUserByID(ctx, 10)
+	if err != nil || u == nil || u.PWord != "" {
+		t.Errorf("GetUserByID() = %+v, %v, want user without pword", u, err)
+	}
+	if err := r.DelUser(ctx, 10); err != nil {
+		t.Fatalf("DelUser() error = %v", err)
+	}
+	if u, err := r.GetUserByID(ctx, 10); u != nil || err != nil {
+		t.Errorf("GetUserByID() of deleted = %+v, %v, want nil, nil", u, err)
+	}
+}
+
+func TestMemRepo_concurrent(t *testing.T) {
+	ctx := context.Background()
+	r, err := NewMemRepo()
+	if err != nil {
+		t.Fatalf("NewMemRepo() error = %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u, err := r.AddUser(ctx, domain.User{Login: "user" + strconv.Itoa(i), PWord: "p"})
+			if err != nil {
+				t.Errorf("AddUser() error = %v", err)
+				return
+			}
+			if _, _, err := r.GetUsers(ctx, 0, 100); err != nil {
+				t.Errorf("GetUsers() error = %v", err)
+			}
+			if err := r.DelUser(ctx, u.UserID); err != nil {
+				t.Errorf("DelUser() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if _, total, _ := r.GetUsers(ctx, 0, 100); total != 0 {
+		t.Errorf("GetUsers() total = %d, want 0", total)
+	}
+}
+
+func TestNewMemRepo_duplicates(t *testing.T) {
+	if _, err := NewMemRepo(domain.User{Login: "admin"}, domain.User{Login: "admin"}); !errors.Is(err, ErrLoginExists) {
+		t.Errorf("NewMemRepo() with duplicate login error = %v, want %v", err, ErrLoginExists)
+	}
+	if _, err := NewMemRepo(domain.User{UserID: 1, Login: "a"}, domain.User{UserID: 1, Login: "b"}); err == nil {
+		t.Errorf("NewMemRepo() with duplicate id must fail")
+	}
+}
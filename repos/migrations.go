@@ -0,0 +1,67 @@
+package repos
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const autoIDMacro string = "{{auto_id}}"
+
+// migrations schema of the sql users repositories, shared by all dialects,
+// applied in order once and recorded in schema_migrations, never edit applied ones - append new
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+	user_id ` + autoIDMacro + `,
+	user_name TEXT NOT NULL DEFAULT '',
+	user_full_name TEXT NOT NULL DEFAULT '',
+	domain_name TEXT NOT NULL DEFAULT '',
+	login TEXT NOT NULL UNIQUE,
+	pword TEXT NOT NULL DEFAULT '',
+	post TEXT NOT NULL DEFAULT '',
+	email TEXT NOT NULL DEFAULT '',
+	phone TEXT NOT NULL DEFAULT '',
+	smtp TEXT NOT NULL DEFAULT '',
+	email_password TEXT NOT NULL DEFAULT '',
+	options TEXT NOT NULL DEFAULT '',
+	comment TEXT NOT NULL DEFAULT ''
+)`,
+}
+
+// migrationSQL returns statement of the migration for the dialect
+func migrationSQL(d Dialect, m string) string {
+	return strings.ReplaceAll(m, autoIDMacro, d.AutoID)
+}
+
+// migrate applies migrations which aren't recorded in schema_migrations
+func (r *SQLRepo) migrate(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations error, %w", err)
+	}
+	var applied sql.NullInt64
+	if err := r.db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&applied); err != nil {
+		return fmt.Errorf("read schema version error, %w", err)
+	}
+	for i := int(applied.Int64); i < len(migrations); i++ {
+		version := i + 1
+		tx, err := r.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, migrationSQL(r.dialect, migrations[i])); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("apply migration %d error, %w", version, err)
+		}
+		if _, err := tx.ExecContext(ctx, r.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("record migration %d error, %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		r.log.Infof("migration %d applied", version)
+	}
+	return nil
+}
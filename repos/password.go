@@ -0,0 +1,30 @@
+package repos
+
+import (
+	"strings"
+
+	"git.countmax.ru/countmax/cmaxdb"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const bcryptPrefix string = "$2"
+
+// hashPass makes bcrypt hash of the password for the repos which store passwords themselves;
+// the hash scheme of countmax523 is private to cmaxdb, so cmaxdb.UserСheckPass can't check these hashes
+// and users of the memory and sql repos can't be moved to countmax523 without resetting their passwords
+func hashPass(pass string) (string, error) {
+	bts, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(bts), nil
+}
+
+// checkPass checks password against bcrypt hash made by hashPass,
+// other hashes are checked by cmaxdb, so users copied from countmax523 keep their passwords
+func checkPass(hash, pass string) bool {
+	if strings.HasPrefix(hash, bcryptPrefix) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	}
+	return cmaxdb.UserСheckPass(hash, pass)
+}
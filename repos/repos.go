@@ -13,14 +13,31 @@ import (
 	"go.uber.org/zap"
 )
 
-// ErrLoginPass stat error about check credentials
-var ErrLoginPass = errors.New("login or pass didn't match")
+var (
+	// ErrLoginPass stat error about check credentials
+	ErrLoginPass = errors.New("login or pass didn't match")
+	// ErrLoginExists stat error about adding user with login already in the repo
+	ErrLoginExists = errors.New("user with this login already exists")
+)
+
+// cmaxClient calls of the cmaxdb.CMAX used by the CMRepo
+type cmaxClient interface {
+	GetUserByLogin(ctx context.Context, login string) (*cmaxdb.User, error)
+	CreateUser(ctx context.Context, u cmaxdb.User) (int64, error)
+	UpdUserPass(ctx context.Context, id int64, pass string) (int64, error)
+	GetUsers(ctx context.Context, offset, limit int64) ([]cmaxdb.User, int64, error)
+	GetUserByID(ctx context.Context, id int64) (*cmaxdb.User, error)
+	DelUser(ctx context.Context, u cmaxdb.User) (int64, error)
+	GetSrvPortDB() string
+	HealthWithContext(ctx context.Context) error
+}
 
-// CMRepo implementation of the domain.IUserRepo
+// CMRepo implementation of the domain.IUserRepo,
+// every call is limited by timeout and canceled with the caller context
 type CMRepo struct {
 	domain.DefImplUserRepoI
 	timeout time.Duration
-	cm      *cmaxdb.CMAX
+	cm      cmaxClient
 	log     *zap.SugaredLogger
 }
 
@@ -42,8 +59,8 @@ func NewCMRepo(cs string, timeout time.Duration, logger *zap.SugaredLogger) (*CM
 
 // Login extract user by login and check pass;
 // if user not fond error, if pass not match error
-func (cmr *CMRepo) Login(uLogin, uPass string) (*domain.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), cmr.timeout)
+func (cmr *CMRepo) Login(ctx context.Context, uLogin, uPass string) (*domain.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, cmr.timeout)
 	defer cancel()
 	u, err := cmr.cm.GetUserByLogin(ctx, uLogin)
 	if err != nil {
@@ -74,7 +91,7 @@ func (cmr *CMRepo) Login(uLogin, uPass string) (*domain.User, error) {
 }
 
 // AddUser creates new user in the repo
-func (cmr *CMRepo) AddUser(u domain.User) (*domain.User, error) {
+func (cmr *CMRepo) AddUser(ctx context.Context, u domain.User) (*domain.User, error) {
 	cu := cmaxdb.User{
 		UserID:       u.UserID,
 		UserName:     u.UserName,
@@ -90,7 +107,7 @@ func (cmr *CMRepo) AddUser(u domain.User) (*domain.User, error) {
 		Options:      u.Options,
 		Comment:      u.Comment,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), cmr.timeout)
+	ctx, cancel := context.WithTimeout(ctx, cmr.timeout)
 	defer cancel()
 	id, err := cmr.cm.CreateUser(ctx, cu)
 	if err != nil {
@@ -101,23 +118,23 @@ func (cmr *CMRepo) AddUser(u domain.User) (*domain.User, error) {
 }
 
 // UserSetPass upd password for specified user id
-func (cmr *CMRepo) UserSetPass(id int64, pass string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), cmr.timeout)
+func (cmr *CMRepo) UserSetPass(ctx context.Context, id int64, pass string) error {
+	ctx, cancel := context.WithTimeout(ctx, cmr.timeout)
 	defer cancel()
 	_, err := cmr.cm.UpdUserPass(ctx, id, pass)
 	return err
 }
 
 // GetUsers extracts users from repo
-func (cmr *CMRepo) GetUsers(offset, limit int64) (domain.Users, int64, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), cmr.timeout)
+func (cmr *CMRepo) GetUsers(ctx context.Context, offset, limit int64) (domain.Users, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, cmr.timeout)
 	defer cancel()
 	cusers, count, err := cmr.cm.GetUsers(ctx, offset, limit)
 	if err != nil {
 		return nil, 0, err
 	}
 	if len(cusers) == 0 {
-		return nil, 0, nil
+		return nil, count, nil
 	}
 	users := make(domain.Users, len(cusers))
 	for i, cu := range cusers {
@@ -141,8 +158,8 @@ func (cmr *CMRepo) GetUsers(offset, limit int64) (domain.Users, int64, error) {
 }
 
 // GetUserByID extracts specified user from repo
-func (cmr *CMRepo) GetUserByID(id int64) (*domain.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), cmr.timeout)
+func (cmr *CMRepo) GetUserByID(ctx context.Context, id int64) (*domain.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, cmr.timeout)
 	defer cancel()
 	cu, err := cmr.cm.GetUserByID(ctx, id)
 	if err != nil {
@@ -170,8 +187,8 @@ func (cmr *CMRepo) GetUserByID(id int64) (*domain.User, error) {
 }
 
 // DelUser erase user record from repo
-func (cmr *CMRepo) DelUser(id int64) error {
-	ctx, cancel := context.WithTimeout(context.Background(), cmr.timeout)
+func (cmr *CMRepo) DelUser(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, cmr.timeout)
 	defer cancel()
 	u := cmaxdb.User{
 		UserID: id,
@@ -187,8 +204,8 @@ func (cmr *CMRepo) GetSrvPortDB() string {
 }
 
 // HealthCheck makes ping to database
-func (cmr *CMRepo) HealthCheck() error {
-	ctx, cancel := context.WithTimeout(context.Background(), cmr.timeout)
+func (cmr *CMRepo) HealthCheck(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, cmr.timeout)
 	defer cancel()
 	return cmr.cm.HealthWithContext(ctx)
 }
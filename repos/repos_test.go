@@ -0,0 +1,91 @@
+package repos
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.countmax.ru/countmax/cmaxdb"
+	"git.countmax.ru/countmax/wda.back/domain"
+	"go.uber.org/zap"
+)
+
+// fakeCMAX countmax523 users table in memory
+type fakeCMAX struct {
+	cmaxClient
+	users []cmaxdb.User
+}
+
+func (f *fakeCMAX) GetUsers(ctx context.Context, offset, limit int64) ([]cmaxdb.User, int64, error) {
+	total := int64(len(f.users))
+	if offset >= total {
+		return nil, total, nil
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return f.users[offset:end], total, nil
+}
+
+func TestRepos_GetUsersAgree(t *testing.T) {
+	logins := []string{"admin", "user1", "user2"}
+	seed := make(domain.Users, len(logins))
+	cm := &fakeCMAX{}
+	for i, l := range logins {
+		seed[i] = domain.User{Login: l, PWord: "p"}
+		cm.users = append(cm.users, cmaxdb.User{UserID: int64(i + 1), Login: l})
+	}
+	mem, err := New(Config{Source: SourceMemory, Seed: seed}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("New(memory) error = %v", err)
+	}
+	dir, err := ioutil.TempDir("", "repos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sqlite, err := NewSQLRepo(SQLite, "file:"+filepath.Join(dir, "users.db"), 0, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("NewSQLRepo() error = %v", err)
+	}
+	defer sqlite.db.Close()
+	ctx := context.Background()
+	for _, u := range seed {
+		if _, err := sqlite.AddUser(ctx, u); err != nil {
+			t.Fatalf("AddUser() error = %v", err)
+		}
+	}
+	repos := map[string]domain.UserRepoI{
+		SourceMemory:   mem,
+		SourceSQLite:   sqlite,
+		SourceCountmax: &CMRepo{timeout: time.Second, cm: cm},
+	}
+	tests := []struct {
+		name    string
+		offset  int64
+		limit   int64
+		wantLen int
+	}{
+		{"all", 0, 10, 3},
+		{"page", 1, 1, 1},
+		{"empty_page", 5, 10, 0},
+	}
+	for _, tt := range tests {
+		for src, r := range repos {
+			t.Run(tt.name+"_"+src, func(t *testing.T) {
+				users, total, err := r.GetUsers(ctx, tt.offset, tt.limit)
+				if err != nil {
+					t.Fatalf("GetUsers() error = %v", err)
+				}
+				if total != int64(len(logins)) || len(users) != tt.wantLen {
+					t.Errorf("GetUsers(%d, %d) = %d users, total %d, want %d users, total %d",
+						tt.offset, tt.limit, len(users), total, tt.wantLen, len(logins))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package repos
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.countmax.ru/countmax/wda.back/domain"
+	"go.uber.org/zap"
+)
+
+// Dialect sql differences of the database
+type Dialect struct {
+	Name       string // name of the users.source
+	Driver     string // name of the database/sql driver
+	Positional bool   // $1, $2 placeholders instead of ?
+	AutoID     string // definition of the auto increment primary key column
+
+	isUniqueViolation func(error) bool
+}
+
+// supported dialects
+var (
+	Postgres = Dialect{Name: SourcePostgres, Driver: "pgx", Positional: true, AutoID: "BIGSERIAL PRIMARY KEY",
+		isUniqueViolation: pgIsUniqueViolation}
+	SQLite = Dialect{Name: SourceSQLite, Driver: "sqlite", AutoID: "INTEGER PRIMARY KEY AUTOINCREMENT",
+		isUniqueViolation: sqliteIsUniqueViolation}
+)
+
+const (
+	defaultTimeout time.Duration = 10 * time.Second
+	redactedDSN    string        = "redacted"
+)
+
+const userColumns string = `user_id, user_name, user_full_name, domain_name, login, post, email, phone, smtp, email_password, options, comment`
+
+// SQLRepo implementation of the domain.IUserRepo in the sql database, schema is migrated on start
+type SQLRepo struct {
+	domain.DefImplUserRepoI
+	dialect Dialect
+	db      *sql.DB
+	scope   string
+	timeout time.Duration
+	log     *zap.SugaredLogger
+}
+
+// NewSQLRepo makes new instance of the SQLRepo, connects to the database and migrates its schema,
+// timeout is defaultTimeout if not defined
+func NewSQLRepo(d Dialect, dsn string, timeout time.Duration, logger *zap.SugaredLogger) (*SQLRepo, error) {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	db, err := sql.Open(d.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	scope := d.Name + ":" + dsnScope(d, dsn)
+	r := &SQLRepo{
+		dialect: d,
+		db:      db,
+		scope:   scope,
+		timeout: timeout,
+		log:     logger.With(zap.String("dbserver", scope)),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect to %s error, %w", scope, err)
+	}
+	if err := r.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Login extract user by login and check pass;
+// if user not fond error, if pass not match error
+func (r *SQLRepo) Login(ctx context.Context, uLogin, uPass string) (*domain.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	row := r.db.QueryRowContext(ctx, r.rebind(`SELECT `+userColumns+`, pword FROM users WHERE login = ?`), uLogin)
+	u := &domain.User{}
+	err := row.Scan(append(userFields(u), &u.PWord)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrLoginPass
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !checkPass(u.PWord, uPass) {
+		return nil, ErrLoginPass
+	}
+	return u, nil
+}
+
+// AddUser creates new user in the repo
+func (r *SQLRepo) AddUser(ctx context.Context, u domain.User) (*domain.User, error) {
+	hash, err := hashPass(u.PWord)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	row := r.db.QueryRowContext(ctx, r.rebind(`INSERT INTO users
+	(user_name, user_full_name, domain_name, login, pword, post, email, phone, smtp, email_password, options, comment)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING user_id`),
+		u.UserName, u.UserFullName, u.DomainName, u.Login, hash, u.Post, u.EMail, u.Telefon,
+		u.SMTP, u.EMailPWord, u.Options, u.Comment)
+	if err := row.Scan(&u.UserID); err != nil {
+		if r.dialect.isUniqueViolation(err) {
+			return nil, ErrLoginExists
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+// UserSetPass upd password for specified user id
+func (r *SQLRepo) UserSetPass(ctx context.Context, id int64, pass string) error {
+	hash, err := hashPass(pass)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	_, err = r.db.ExecContext(ctx, r.rebind(`UPDATE users SET pword = ? WHERE user_id = ?`), hash, id)
+	return err
+}
+
+// GetUsers extracts users from repo
+func (r *SQLRepo) GetUsers(ctx context.Context, offset, limit int64) (domain.Users, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	var total int64
+	if err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := r.db.QueryContext(ctx,
+		r.rebind(`SELECT `+userColumns+` FROM users ORDER BY user_id LIMIT ? OFFSET ?`), limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var users domain.Users
+	for rows.Next() {
+		u := domain.User{}
+		if err := rows.Scan(userFields(&u)...); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// GetUserByID extracts specified user from repo
+func (r *SQLRepo) GetUserByID(ctx context.Context, id int64) (*domain.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	u := &domain.User{}
+	err := r.db.QueryRowContext(ctx, r.rebind(`SELECT `+userColumns+` FROM users WHERE user_id = ?`), id).
+		Scan(userFields(u)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// DelUser erase user record from repo
+func (r *SQLRepo) DelUser(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	_, err := r.db.ExecContext(ctx, r.rebind(`DELETE FROM users WHERE user_id = ?`), id)
+	return err
+}
+
+// GetSrvPortDB make [dialect]:[host]/[db] string
+func (r *SQLRepo) GetSrvPortDB() string {
+	return r.scope
+}
+
+// HealthCheck makes ping to database
+func (r *SQLRepo) HealthCheck(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return r.db.PingContext(ctx)
+}
+
+// rebind replaces ? placeholders by positional ones if the dialect requires them
+func (r *SQLRepo) rebind(query string) string {
+	if !r.dialect.Positional {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, ch := range query {
+		if ch != '?' {
+			b.WriteRune(ch)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// userFields returns destinations of userColumns
+func userFields(u *domain.User) []interface{} {
+	return []interface{}{
+		&u.UserID, &u.UserName, &u.UserFullName, &u.DomainName, &u.Login, &u.Post,
+		&u.EMail, &u.Telefon, &u.SMTP, &u.EMailPWord, &u.Options, &u.Comment,
+	}
+}
+
+// dsnScope returns host and database of the dsn without credentials and parameters,
+// file of the sqlite; keyword/value dsn isn't parsed, so it is redacted entirely
+func dsnScope(d Dialect, dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Host != "" {
+		return u.Host + u.Path
+	}
+	if d.Name == SourceSQLite {
+		return strings.SplitN(strings.TrimPrefix(dsn, "file:"), "?", 2)[0]
+	}
+	return redactedDSN
+}
@@ -0,0 +1,120 @@
+package repos
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.countmax.ru/countmax/wda.back/domain"
+	"go.uber.org/zap"
+)
+
+func TestSQLRepo_rebind(t *testing.T) {
+	query := `UPDATE users SET pword = ? WHERE user_id = ?`
+	tests := []struct {
+		name    string
+		dialect Dialect
+		want    string
+	}{
+		{"postgres", Postgres, `UPDATE users SET pword = $1 WHERE user_id = $2`},
+		{"sqlite", SQLite, query},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &SQLRepo{dialect: tt.dialect}
+			if got := r.rebind(query); got != tt.want {
+				t.Errorf("SQLRepo.rebind() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_migrationSQL(t *testing.T) {
+	for _, d := range []Dialect{Postgres, SQLite} {
+		for i, m := range migrations {
+			got := migrationSQL(d, m)
+			if strings.Contains(got, "{{") {
+				t.Errorf("%s migration %d has unresolved macro, %s", d.Name, i+1, got)
+			}
+		}
+	}
+	if got := migrationSQL(Postgres, migrations[0]); !strings.Contains(got, "user_id BIGSERIAL PRIMARY KEY") {
+		t.Errorf("postgres users table must have BIGSERIAL id, %s", got)
+	}
+}
+
+func Test_dsnScope(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		dsn     string
+		want    string
+	}{
+		{Postgres, "postgres://wda:secret@db:5432/wda?sslmode=disable", "db:5432/wda"},
+		{Postgres, "host=db user=wda password=secret dbname=users", redactedDSN},
+		{SQLite, "file:/var/lib/wda/users.db?_pragma=busy_timeout(5000)", "/var/lib/wda/users.db"},
+		{SQLite, "users.db", "users.db"},
+	}
+	for _, tt := range tests {
+		if got := dsnScope(tt.dialect, tt.dsn); got != tt.want {
+			t.Errorf("dsnScope(%s, %s) = %s, want %s", tt.dialect.Name, tt.dsn, got, tt.want)
+		}
+	}
+}
+
+func TestSQLRepo_sqlite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlrepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := "file:" + filepath.Join(dir, "users.db")
+	r, err := NewSQLRepo(SQLite, dsn, 0, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("NewSQLRepo() error = %v", err)
+	}
+	ctx := context.Background()
+	u, err := r.AddUser(ctx, domain.User{Login: "ivanov", PWord: "s3cret", EMailPWord: "mail"})
+	if err != nil {
+		t.Fatalf("AddUser() error = %v", err)
+	}
+	if _, err := r.AddUser(ctx, domain.User{Login: "ivanov", PWord: "other"}); !errors.Is(err, ErrLoginExists) {
+		t.Errorf("AddUser() of the same login error = %v, want %v", err, ErrLoginExists)
+	}
+	if _, err := r.Login(ctx, "ivanov", "s3cret"); err != nil {
+		t.Errorf("Login() error = %v", err)
+	}
+	if _, err := r.Login(ctx, "ivanov", "wrong"); !errors.Is(err, ErrLoginPass) {
+		t.Errorf("Login() with wrong pass error = %v, want %v", err, ErrLoginPass)
+	}
+	users, total, err := r.GetUsers(ctx, 0, 10)
+	if err != nil || total != 1 || len(users) != 1 || users[0].PWord != "" {
+		t.Errorf("GetUsers() = %+v, %d, %v, want one user without pword", users, total, err)
+	}
+	if err := r.DelUser(ctx, u.UserID); err != nil {
+		t.Fatalf("DelUser() error = %v", err)
+	}
+	if got, err := r.GetUserByID(ctx, u.UserID); got != nil || err != nil {
+		t.Errorf("GetUserByID() of deleted = %+v, %v, want nil, nil", got, err)
+	}
+	r.db.Close()
+	// migrations are applied once
+	r, err = NewSQLRepo(SQLite, dsn, 0, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("NewSQLRepo() of migrated database error = %v", err)
+	}
+	r.db.Close()
+}
+
+func Test_checkPass(t *testing.T) {
+	hash, err := hashPass("s3cret")
+	if err != nil {
+		t.Fatalf("hashPass() error = %v", err)
+	}
+	if !checkPass(hash, "s3cret") || checkPass(hash, "wrong") {
+		t.Errorf("checkPass() of bcrypt hash is wrong")
+	}
+}